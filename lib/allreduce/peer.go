@@ -0,0 +1,185 @@
+package allreduce
+
+import (
+	"comp3200/lib"
+	"comp3200/lib/messenger"
+	"comp3200/lib/network"
+	"fmt"
+	"log"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// Peer is a struct that represents a single member of an all-reduce ring
+type Peer struct {
+	model *network.Network
+	rank  int
+	size  int
+	next  messenger.Messenger
+	prev  messenger.Messenger
+}
+
+// LaunchPeer starts a ring all-reduce peer on a specified address, peers lists every address in the ring in order
+func LaunchPeer(address string, peers []string, model *network.Network, data *network.Data) {
+	p := Peer{model: model, rank: -1, size: len(peers)}
+	for i, peer := range peers {
+		if peer == address {
+			p.rank = i
+		}
+	}
+	if p.rank == -1 {
+		log.Println("ERR: address", address, "is not in the list of peers")
+		return
+	}
+	log.Println("Launching all-reduce peer", p.rank, "of", p.size)
+
+	if p.size > 1 {
+		l, err := messenger.Listen(address)
+		if err != nil {
+			log.Println("ERR:", err)
+			return
+		}
+
+		// Accept the previous peer while connecting to the next one so the ring can form in any order
+		accepted := make(chan error)
+		go func() {
+			conn, err := l.Accept()
+			if err == nil {
+				p.prev, err = messenger.Accept(conn)
+			}
+			accepted <- err
+		}()
+		p.next, err = messenger.Connect(peers[(p.rank+1)%p.size])
+		if err != nil {
+			log.Println("ERR:", err)
+			return
+		}
+		defer p.next.Close()
+
+		err = <-accepted
+		if err != nil {
+			log.Println("ERR:", err)
+			return
+		}
+		defer p.prev.Close()
+		log.Println("Joined ring")
+
+		err = p.broadcastParameters()
+		if err != nil {
+			log.Println("ERR: could not receive initial parameters", err)
+			return
+		}
+	}
+
+	partition := data.Partition(p.size)[p.rank]
+	miniBatches := partition.GetMiniBatches(lib.MiniBatchSize)
+	idx := 0
+	steps := 0
+	for {
+		weights, biases := p.model.Train(miniBatches[idx])
+
+		// Sum the gradients of every peer and average them
+		flat := network.FlattenParameters(weights, biases)
+		err := p.allReduce(flat)
+		if err != nil {
+			// Every step needs the whole ring so training cannot continue without a peer
+			log.Println("ERR: lost connection to ring", err)
+			return
+		}
+		for i := range flat {
+			flat[i] /= float64(p.size)
+		}
+		network.UnflattenParameters(flat, weights, biases)
+
+		p.model.UpdateWithDeltas(weights, biases)
+
+		idx++
+		if idx >= len(miniBatches) {
+			miniBatches = partition.GetMiniBatches(lib.MiniBatchSize)
+			idx = 0
+		}
+
+		steps++
+		if steps%1000 == 0 {
+			log.Println("Completed", steps, "steps")
+		}
+	}
+}
+
+// broadcastParameters passes the parameters of peer 0 around the ring so that every peer starts from the same model
+func (p *Peer) broadcastParameters() error {
+	if p.rank == 0 {
+		weights, biases := p.model.Parameters()
+		return p.next.Send(messenger.Snapshot, weights, biases)
+	}
+
+	var weights []mat.Dense
+	var biases []mat.VecDense
+	err := p.prev.Expect(messenger.Snapshot, &weights, &biases)
+	if err != nil {
+		return err
+	}
+	p.model.SetParameters(weights, biases)
+
+	if p.rank != p.size-1 {
+		return p.next.Send(messenger.Snapshot, weights, biases)
+	}
+	return nil
+}
+
+// chunk returns the bounds of the ith of size equal chunks of a slice of length n
+func (p *Peer) chunk(i int, n int) (int, int) {
+	i = ((i % p.size) + p.size) % p.size
+	return i * n / p.size, (i + 1) * n / p.size
+}
+
+// exchange sends chunk send of vec to the next peer while receiving chunk recv from the previous peer
+func (p *Peer) exchange(vec []float64, send int, recv int) ([]float64, error) {
+	start, end := p.chunk(send, len(vec))
+	recvStart, recvEnd := p.chunk(recv, len(vec))
+	sent := make(chan error)
+	go func() {
+		sent <- p.next.Send(messenger.Chunk, vec[start:end])
+	}()
+
+	var received []float64
+	err := p.prev.Expect(messenger.Chunk, &received)
+	sendErr := <-sent
+	if err != nil {
+		return nil, err
+	}
+
+	// A peer with a different model would send chunks of a different length
+	if len(received) != recvEnd-recvStart {
+		return nil, fmt.Errorf("received a chunk of %d elements, expected %d", len(received), recvEnd-recvStart)
+	}
+	return received, sendErr
+}
+
+// allReduce sums vec element-wise across every peer in the ring, leaving the result in vec
+func (p *Peer) allReduce(vec []float64) error {
+	// Reduce-scatter, after which this peer holds the complete sum of chunk rank+1
+	for s := 0; s < p.size-1; s++ {
+		recv := p.rank - s - 1
+		received, err := p.exchange(vec, p.rank-s, recv)
+		if err != nil {
+			return err
+		}
+		start, _ := p.chunk(recv, len(vec))
+		for i, v := range received {
+			vec[start+i] += v
+		}
+	}
+
+	// All-gather, circulating each complete chunk around the ring
+	for s := 0; s < p.size-1; s++ {
+		recv := p.rank - s
+		received, err := p.exchange(vec, p.rank+1-s, recv)
+		if err != nil {
+			return err
+		}
+		start, _ := p.chunk(recv, len(vec))
+		copy(vec[start:], received)
+	}
+	return nil
+}
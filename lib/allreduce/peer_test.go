@@ -0,0 +1,134 @@
+package allreduce
+
+import (
+	"comp3200/lib/messenger"
+	"comp3200/lib/network"
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// ring connects size peers of models in a ring over pipes, closing them when the returned function is called
+func ring(models []*network.Network) ([]*Peer, func()) {
+	size := len(models)
+	peers := make([]*Peer, size)
+	for i := range peers {
+		peers[i] = &Peer{model: models[i], rank: i, size: size}
+	}
+
+	var conns []net.Conn
+	for i := range peers {
+		out, in := net.Pipe()
+		peers[i].next = messenger.NewMessenger(out)
+		peers[(i+1)%size].prev = messenger.NewMessenger(in)
+		conns = append(conns, out, in)
+	}
+	return peers, func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+}
+
+// concurrently runs f on every peer at once, as each step of the ring needs every peer, and returns each peer's error
+func concurrently(peers []*Peer, f func(p *Peer) error) []error {
+	errs := make([]error, len(peers))
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		wg.Add(1)
+		go func(i int, p *Peer) {
+			defer wg.Done()
+			errs[i] = f(p)
+		}(i, p)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestAllReduce(t *testing.T) {
+	// Vectors shorter than the ring leave some chunks empty
+	for _, size := range []int{1, 2, 3, 5} {
+		for _, length := range []int{3, 10} {
+			t.Run(fmt.Sprintf("size=%d,length=%d", size, length), func(t *testing.T) {
+				peers, closeRing := ring(make([]*network.Network, size))
+				defer closeRing()
+
+				vecs := make([][]float64, size)
+				sum := make([]float64, length)
+				for i := range vecs {
+					vecs[i] = make([]float64, length)
+					for j := range vecs[i] {
+						vecs[i][j] = float64((i+1)*(j+1)) + 0.5
+						sum[j] += vecs[i][j]
+					}
+				}
+
+				errs := concurrently(peers, func(p *Peer) error {
+					return p.allReduce(vecs[p.rank])
+				})
+				for i, err := range errs {
+					if err != nil {
+						t.Fatalf("peer %d: %v", i, err)
+					}
+				}
+				for i, vec := range vecs {
+					for j := range vec {
+						if math.Abs(vec[j]-sum[j]) > 1e-9 {
+							t.Fatalf("peer %d reduced element %d to %f, expected %f", i, j, vec[j], sum[j])
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestAllReduceDifferentLengths(t *testing.T) {
+	peers, closeRing := ring(make([]*network.Network, 3))
+	defer closeRing()
+
+	// Closing the ring on the first error releases the peers still waiting on it
+	var once sync.Once
+	errs := concurrently(peers, func(p *Peer) error {
+		length := 9
+		if p.rank == 1 {
+			length = 12
+		}
+		err := p.allReduce(make([]float64, length))
+		if err != nil {
+			once.Do(closeRing)
+		}
+		return err
+	})
+	for i, err := range errs {
+		if err == nil {
+			t.Errorf("peer %d reduced vectors of different lengths", i)
+		}
+	}
+}
+
+func TestBroadcastParameters(t *testing.T) {
+	models := make([]*network.Network, 4)
+	models[0] = network.NewNetwork().WithLayer(4, 3, "sigmoid").WithLayer(3, 2, "softmax")
+	for i := 1; i < len(models); i++ {
+		models[i] = network.NewNetworkFromConfig(models[0].Config)
+	}
+	peers, closeRing := ring(models)
+	defer closeRing()
+
+	errs := concurrently(peers, func(p *Peer) error {
+		return p.broadcastParameters()
+	})
+	expected := network.FlattenParameters(models[0].Parameters())
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("peer %d: %v", i, err)
+		}
+		if got := network.FlattenParameters(models[i].Parameters()); !reflect.DeepEqual(got, expected) {
+			t.Errorf("peer %d started from different parameters to peer 0", i)
+		}
+	}
+}
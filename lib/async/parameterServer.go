@@ -0,0 +1,102 @@
+package async
+
+import (
+	"comp3200/lib/compression"
+	"comp3200/lib/messenger"
+	"comp3200/lib/network"
+	"errors"
+	"log"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// ParameterServer is a struct that represents a Hogwild parameter server. Unlike a Downpour server it keeps no versions
+// and takes no lock over the whole model, each push is applied layer by layer while other pushes and pulls run
+type ParameterServer struct {
+	model *network.Network
+}
+
+// LaunchParameterServer starts a Hogwild parameter server serving model
+func LaunchParameterServer(address string, model *network.Network) {
+	log.Println("Launching Hogwild parameter server")
+	ps := ParameterServer{model: model}
+
+	l, err := messenger.Listen(address)
+	if err != nil {
+		log.Println("ERR:", err)
+		return
+	}
+
+	err = messenger.Serve(l, ps.handleConnection)
+	log.Println("ERR:", err)
+}
+
+func (ps *ParameterServer) handleConnection(msg messenger.Messenger) {
+	log.Println("New worker connected")
+	defer msg.Close()
+	// The compression scheme this worker's updates use, agreed in its model request
+	scheme := compression.None
+	for {
+		env, err := msg.Receive()
+
+		if err == nil {
+			switch env.Kind {
+			case messenger.ParameterRequest:
+				err = ps.handleParameterRequest(msg, env)
+				break
+			case messenger.ParameterUpdate:
+				err = ps.handleParameterUpdate(env, scheme)
+				break
+			case messenger.ModelRequest:
+				scheme, err = ps.handleModelRequest(msg, env)
+				break
+			default:
+				err = messenger.Unexpected(env)
+			}
+		}
+
+		if errors.Is(err, messenger.ErrPeerClosed) {
+			log.Println("Worker disconnected")
+			return
+		} else if errors.Is(err, messenger.ErrTimeout) {
+			log.Println("Worker timed out, assuming it is dead")
+			return
+		} else if err != nil {
+			log.Println("ERR:", err)
+			return
+		}
+	}
+}
+
+// handleParameterRequest replies with the parameters of each layer as they are when that layer is read,
+// so a reply may mix layers from before and after a push that is being applied
+func (ps *ParameterServer) handleParameterRequest(msg messenger.Messenger, request messenger.Envelope) error {
+	var weights []mat.Dense
+	var biases []mat.VecDense
+	for j := 0; j < ps.model.Layers(); j++ {
+		w, b := ps.model.LayerParameters(j)
+		weights = append(weights, w)
+		biases = append(biases, b)
+	}
+
+	return msg.Reply(request, weights, biases)
+}
+
+func (ps *ParameterServer) handleModelRequest(msg messenger.Messenger, request messenger.Envelope) (compression.Scheme, error) {
+	scheme := compression.Negotiate(request)
+	log.Println("Worker compresses updates with", scheme)
+	return scheme, msg.Reply(request, ps.model.Config, scheme.String())
+}
+
+// handleParameterUpdate applies a push one layer at a time, whatever the version it was computed on
+func (ps *ParameterServer) handleParameterUpdate(update messenger.Envelope, scheme compression.Scheme) error {
+	_, weightDeltas, biasDeltas, err := compression.ReceiveDeltas(update, scheme, ps.model)
+	if err != nil {
+		return err
+	}
+
+	for j := range weightDeltas {
+		ps.model.UpdateLayerWithDeltas(j, &weightDeltas[j], &biasDeltas[j])
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package async
+
+import (
+	"comp3200/lib/compression"
+	"comp3200/lib/messenger"
+	"comp3200/lib/network"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+)
+
+// servers counts the parameter servers started, as a server keeps its address until the process exits
+var servers int
+
+// launch starts a Hogwild parameter server serving model and returns its address
+func launch(model *network.Network) string {
+	servers++
+	address := fmt.Sprintf("%shogwild%d", messenger.MemoryScheme, servers)
+	go LaunchParameterServer(address, model)
+	return address
+}
+
+// TestConcurrentPushes checks that pushes applied layer by layer while other pushes are being applied are never lost
+func TestConcurrentPushes(t *testing.T) {
+	model := network.NewNetwork().WithLayer(4, 3, "sigmoid").WithLayer(3, 2, "softmax").WithLearningRate(0.5)
+	before, beforeBiases := model.Parameters()
+	address := launch(model)
+
+	workers, pushes := 4, 50
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg, err := messenger.Connect(address)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer msg.Close()
+			_, _, err = compression.RequestModel(msg, compression.None)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			weights, biases := model.ZeroedParameters()
+			flat := network.FlattenParameters(weights, biases)
+			for i := range flat {
+				flat[i] = 0.01
+			}
+			network.UnflattenParameters(flat, weights, biases)
+			for p := 0; p < pushes; p++ {
+				err = compression.SendDeltas(msg, nil, 0, weights, biases)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+
+			// A connection is served in order, so once a pull is answered every push before it has been applied
+			_, err = msg.Request(messenger.ParameterRequest)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	weights, biases := model.Parameters()
+	after := network.FlattenParameters(weights, biases)
+	step := 0.5 * 0.01 * float64(workers*pushes)
+	for i, v := range network.FlattenParameters(before, beforeBiases) {
+		if moved := v - after[i]; math.Abs(moved-step) > 1e-9 {
+			t.Fatalf("parameter %d moved %f, expected %f", i, moved, step)
+		}
+	}
+}
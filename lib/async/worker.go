@@ -0,0 +1,77 @@
+package async
+
+import (
+	"comp3200/lib"
+	"comp3200/lib/compression"
+	"comp3200/lib/messenger"
+	"comp3200/lib/network"
+	"log"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// worker is a struct that represents a Hogwild worker, which pulls the parameters, computes the gradient of one
+// mini-batch on them and pushes it without waiting for any other worker
+type worker struct {
+	model      *network.Network
+	compressor *compression.Compressor
+}
+
+// LaunchWorker starts a Hogwild worker training on data against the parameter server at paramAddress, compressing its gradients with scheme
+func LaunchWorker(paramAddress string, data *network.Data, scheme compression.Scheme) {
+	param, err := messenger.Connect(paramAddress)
+	if err != nil {
+		log.Println("ERR:", err)
+		return
+	}
+	defer param.Close()
+
+	networkConfig, agreed, err := compression.RequestModel(param, scheme)
+	if err != nil {
+		log.Println("ERR: could not retrieve model configuration", err)
+		return
+	}
+	w := worker{model: network.NewNetworkFromConfig(networkConfig), compressor: compression.NewCompressor(agreed)}
+	log.Println("Retrieved model configuration, compressing updates with", agreed)
+
+	minibatches := data.GetMiniBatches(lib.MiniBatchSize)
+	idx := 0
+	for {
+		err = w.receiveParameters(param)
+		if err != nil {
+			log.Println("ERR: could not receive parameters", err)
+			return
+		}
+
+		// The gradient is left for the server to apply, so the local model is never updated
+		weights, biases := w.model.Train(minibatches[idx])
+		err = compression.SendDeltas(param, w.compressor, 0, weights, biases)
+		if err != nil {
+			log.Println("ERR: lost connection to parameter server", err)
+			return
+		}
+
+		idx++
+		if idx >= len(minibatches) {
+			minibatches = data.GetMiniBatches(lib.MiniBatchSize)
+			idx = 0
+		}
+	}
+}
+
+func (w *worker) receiveParameters(msg messenger.Messenger) error {
+	reply, err := msg.Request(messenger.ParameterRequest)
+	if err != nil {
+		return err
+	}
+
+	var weights []mat.Dense
+	var biases []mat.VecDense
+	err = reply.Decode(&weights, &biases)
+	if err != nil {
+		return err
+	}
+
+	w.model.SetParameters(weights, biases)
+	return nil
+}
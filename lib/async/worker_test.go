@@ -0,0 +1,38 @@
+package async
+
+import (
+	"comp3200/lib/compression"
+	"comp3200/lib/network"
+	"testing"
+	"time"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// TestWorkerTrains checks that a worker pushing to a server trains the server's model
+func TestWorkerTrains(t *testing.T) {
+	model := network.NewNetwork().WithLayer(2, 8, "sigmoid").WithLayer(8, 10, "softmax").WithLearningRate(0.5)
+	address := launch(model)
+
+	// The class of a record is which of its inputs is larger
+	data := &network.Data{}
+	for i := 0; i < 400; i++ {
+		x, y := float64(i%20)/20, float64(i/20)/20
+		label := 0
+		if y > x {
+			label = 1
+		}
+		data.Train = append(data.Train, network.NewRecord(*mat.NewVecDense(2, []float64{x, y}), label))
+	}
+	test := append([]network.Record(nil), data.Train...)
+	go LaunchWorker(address, data, compression.None)
+
+	var accuracy float64
+	for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		_, accuracy = model.Evaluate(test)
+		if accuracy >= 0.9 {
+			return
+		}
+	}
+	t.Errorf("accuracy only reached %f", accuracy)
+}
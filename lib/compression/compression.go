@@ -0,0 +1,271 @@
+package compression
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Names of the compression schemes
+const (
+	NoCompression = "none"
+	TopK          = "topk"
+	Random        = "random"
+	Quantise8     = "8bit"
+	Quantise1     = "1bit"
+)
+
+// Scheme is a struct that represents a gradient compression scheme, Ratio is the fraction of elements kept by sparsifying schemes
+type Scheme struct {
+	Name  string
+	Ratio float64
+}
+
+// None is the scheme that sends gradients uncompressed
+var None = Scheme{Name: NoCompression}
+
+// ParseScheme parses a scheme written as none, 8bit, 1bit, topk:<ratio> or random:<ratio>
+func ParseScheme(s string) (Scheme, error) {
+	parts := strings.SplitN(s, ":", 2)
+	scheme := Scheme{Name: parts[0]}
+	switch scheme.Name {
+	case NoCompression, Quantise8, Quantise1:
+		if len(parts) > 1 {
+			return None, fmt.Errorf("compression scheme %s takes no ratio", scheme.Name)
+		}
+		return scheme, nil
+	case TopK, Random:
+		if len(parts) < 2 {
+			return None, fmt.Errorf("compression scheme %s needs a ratio, e.g. %s:0.01", scheme.Name, scheme.Name)
+		}
+		ratio, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || ratio <= 0 || ratio > 1 {
+			return None, fmt.Errorf("compression ratio %q must be in (0, 1]", parts[1])
+		}
+		scheme.Ratio = ratio
+		return scheme, nil
+	}
+	return None, fmt.Errorf("unknown compression scheme %q", s)
+}
+
+func (s Scheme) String() string {
+	if s.Name == TopK || s.Name == Random {
+		return s.Name + ":" + strconv.FormatFloat(s.Ratio, 'g', -1, 64)
+	}
+	return s.Name
+}
+
+// Compressed returns whether gradients sent with this scheme are compressed
+func (s Scheme) Compressed() bool {
+	return s.Name != "" && s.Name != NoCompression
+}
+
+// Gradient is a struct that represents a compressed gradient vector of Length elements.
+// Sparse gradients set Indices and Values, quantised gradients set Bits and pack one level per element into Levels
+type Gradient struct {
+	Length  int
+	Indices []int32
+	Values  []float64
+	Bits    int
+	Levels  []byte
+	Low     float64
+	High    float64
+}
+
+// ErrMalformedGradient is returned when a compressed gradient does not describe a vector of the expected length
+var ErrMalformedGradient = errors.New("malformed compressed gradient")
+
+// Decompress expands a compressed gradient back into a dense vector of length elements,
+// returning an error rather than trusting a gradient whose fields do not agree with each other or with length
+func (g Gradient) Decompress(length int) ([]float64, error) {
+	err := g.validate(length)
+	if err != nil {
+		return nil, err
+	}
+	return g.expand(), nil
+}
+
+// validate checks that a gradient can be expanded into a vector of length elements
+func (g Gradient) validate(length int) error {
+	if g.Length != length {
+		return fmt.Errorf("%w: %d elements, expected %d", ErrMalformedGradient, g.Length, length)
+	}
+	switch g.Bits {
+	case 8:
+		if len(g.Levels) != g.Length {
+			return fmt.Errorf("%w: %d 8 bit levels for %d elements", ErrMalformedGradient, len(g.Levels), g.Length)
+		}
+	case 1:
+		if len(g.Levels) != (g.Length+7)/8 {
+			return fmt.Errorf("%w: %d bytes of 1 bit levels for %d elements", ErrMalformedGradient, len(g.Levels), g.Length)
+		}
+	case 0:
+		if len(g.Indices) != len(g.Values) {
+			return fmt.Errorf("%w: %d indices for %d values", ErrMalformedGradient, len(g.Indices), len(g.Values))
+		}
+		for _, index := range g.Indices {
+			if index < 0 || int(index) >= g.Length {
+				return fmt.Errorf("%w: index %d outside %d elements", ErrMalformedGradient, index, g.Length)
+			}
+		}
+	default:
+		return fmt.Errorf("%w: %d bits per element", ErrMalformedGradient, g.Bits)
+	}
+	return nil
+}
+
+// expand expands a gradient that is known to be valid
+func (g Gradient) expand() []float64 {
+	out := make([]float64, g.Length)
+	switch g.Bits {
+	case 8:
+		step := (g.High - g.Low) / 255
+		for i, level := range g.Levels {
+			out[i] = g.Low + float64(level)*step
+		}
+	case 1:
+		for i := range out {
+			if g.Levels[i/8]&(1<<uint(i%8)) != 0 {
+				out[i] = g.High
+			} else {
+				out[i] = g.Low
+			}
+		}
+	default:
+		for i, index := range g.Indices {
+			out[index] = g.Values[i]
+		}
+	}
+	return out
+}
+
+// Compressor is a struct that represents the sending side of a compressed gradient stream.
+// Schemes that drop information deterministically carry what they dropped over to the next gradient (error feedback)
+type Compressor struct {
+	scheme   Scheme
+	residual []float64
+	random   *rand.Rand
+}
+
+// NewCompressor creates a compressor for a scheme
+func NewCompressor(scheme Scheme) *Compressor {
+	return &Compressor{scheme: scheme, random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Scheme returns the scheme this compressor uses
+func (c *Compressor) Scheme() Scheme {
+	return c.scheme
+}
+
+// Compress compresses a gradient vector, grad itself is left unchanged
+func (c *Compressor) Compress(grad []float64) Gradient {
+	// Random sparsification is unbiased on its own, so it does not need error feedback
+	if c.scheme.Name == Random {
+		return c.sparsify(grad, c.random.Perm(len(grad))[:c.keep(len(grad))], float64(len(grad))/float64(c.keep(len(grad))))
+	}
+
+	corrected := make([]float64, len(grad))
+	copy(corrected, grad)
+	if len(c.residual) == len(grad) {
+		for i := range corrected {
+			corrected[i] += c.residual[i]
+		}
+	}
+
+	var g Gradient
+	switch c.scheme.Name {
+	case TopK:
+		g = c.sparsify(corrected, largest(corrected, c.keep(len(grad))), 1)
+	case Quantise8:
+		g = quantise8(corrected)
+	case Quantise1:
+		g = quantise1(corrected)
+	}
+
+	// Whatever was not sent is added to the next gradient
+	c.residual = corrected
+	for i, v := range g.expand() {
+		c.residual[i] -= v
+	}
+	return g
+}
+
+// keep returns the number of elements of an n element vector a sparsifying scheme sends
+func (c *Compressor) keep(n int) int {
+	k := int(math.Ceil(c.scheme.Ratio * float64(n)))
+	if k < 1 {
+		k = 1
+	}
+	if k > n {
+		k = n
+	}
+	return k
+}
+
+// sparsify sends the elements of grad at the given indices, multiplied by scale
+func (c *Compressor) sparsify(grad []float64, indices []int, scale float64) Gradient {
+	g := Gradient{Length: len(grad), Indices: make([]int32, len(indices)), Values: make([]float64, len(indices))}
+	for i, index := range indices {
+		g.Indices[i] = int32(index)
+		g.Values[i] = grad[index] * scale
+	}
+	return g
+}
+
+// largest returns the indices of the k elements of v with the largest magnitude
+func largest(v []float64, k int) []int {
+	indices := make([]int, len(v))
+	for i := range indices {
+		indices[i] = i
+	}
+	sort.Slice(indices, func(i, j int) bool { return math.Abs(v[indices[i]]) > math.Abs(v[indices[j]]) })
+	return indices[:k]
+}
+
+// quantise8 maps every element onto one of 256 evenly spaced levels between the minimum and maximum
+func quantise8(v []float64) Gradient {
+	g := Gradient{Length: len(v), Bits: 8, Levels: make([]byte, len(v))}
+	if len(v) == 0 {
+		return g
+	}
+	g.Low, g.High = v[0], v[0]
+	for _, x := range v {
+		g.Low = math.Min(g.Low, x)
+		g.High = math.Max(g.High, x)
+	}
+	if g.High == g.Low {
+		return g
+	}
+	scale := 255 / (g.High - g.Low)
+	for i, x := range v {
+		g.Levels[i] = byte(math.Round((x - g.Low) * scale))
+	}
+	return g
+}
+
+// quantise1 sends only the sign of each element, reconstructed as the mean of the elements with that sign
+func quantise1(v []float64) Gradient {
+	g := Gradient{Length: len(v), Bits: 1, Levels: make([]byte, (len(v)+7)/8)}
+	positives := 0
+	for i, x := range v {
+		if x >= 0 {
+			g.Levels[i/8] |= 1 << uint(i%8)
+			g.High += x
+			positives++
+		} else {
+			g.Low += x
+		}
+	}
+	if positives > 0 {
+		g.High /= float64(positives)
+	}
+	if positives < len(v) {
+		g.Low /= float64(len(v) - positives)
+	}
+	return g
+}
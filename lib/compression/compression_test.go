@@ -0,0 +1,94 @@
+package compression
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// gradient returns an n element vector with elements of both signs and varying magnitude
+func gradient(n int) []float64 {
+	grad := make([]float64, n)
+	for i := range grad {
+		grad[i] = math.Sin(float64(i)+1) * float64(i%7+1)
+	}
+	return grad
+}
+
+func TestRoundTrip(t *testing.T) {
+	grad := gradient(100)
+
+	for _, name := range []string{"topk:0.1", "random:0.1", Quantise8, Quantise1} {
+		scheme, err := ParseScheme(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := NewCompressor(scheme)
+		c.random = rand.New(rand.NewSource(1))
+
+		sent := make([]float64, len(grad))
+		rounds := 1000
+		for r := 0; r < rounds; r++ {
+			g := c.Compress(grad)
+			out, err := g.Decompress(len(grad))
+			if err != nil {
+				t.Fatal(scheme, err)
+			}
+			for i, v := range out {
+				sent[i] += v
+			}
+		}
+
+		for i, v := range grad {
+			total := float64(rounds) * v
+			if scheme.Name == Random {
+				// Random sparsification has no error feedback but is unbiased, so the mean converges on the gradient
+				if math.Abs(sent[i]-total) > 0.5*math.Abs(total) {
+					t.Errorf("%s: element %d summed to %f over %d rounds, expected about %f", scheme, i, sent[i], rounds, total)
+					break
+				}
+			} else if math.Abs(sent[i]+c.residual[i]-total) > 1e-6 {
+				// With error feedback everything that was not sent is carried over in the residual
+				t.Errorf("%s: element %d summed to %f with %f carried over, expected %f", scheme, i, sent[i], c.residual[i], total)
+				break
+			}
+		}
+	}
+}
+
+func TestQuantise8(t *testing.T) {
+	grad := gradient(50)
+	out, err := quantise8(grad).Decompress(len(grad))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step := 14.0 / 255
+	for i := range grad {
+		if math.Abs(out[i]-grad[i]) > step {
+			t.Errorf("element %d decompressed to %f, was %f", i, out[i], grad[i])
+		}
+	}
+}
+
+func TestMalformedGradients(t *testing.T) {
+	cases := map[string]Gradient{
+		"wrong length":            {Length: 11},
+		"huge length":             {Length: math.MaxInt32},
+		"negative index":          {Length: 10, Indices: []int32{-1}, Values: []float64{1}},
+		"index past end":          {Length: 10, Indices: []int32{10}, Values: []float64{1}},
+		"more indices than value": {Length: 10, Indices: []int32{1, 2}, Values: []float64{1}},
+		"short 8 bit levels":      {Length: 10, Bits: 8, Levels: make([]byte, 9)},
+		"long 8 bit levels":       {Length: 10, Bits: 8, Levels: make([]byte, 11)},
+		"short 1 bit levels":      {Length: 10, Bits: 1, Levels: make([]byte, 1)},
+		"unknown bits":            {Length: 10, Bits: 4, Levels: make([]byte, 5)},
+	}
+
+	for name, g := range cases {
+		_, err := g.Decompress(10)
+		if !errors.Is(err, ErrMalformedGradient) {
+			t.Errorf("%s: decompressed with error %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package compression
+
+import (
+	"comp3200/lib/messenger"
+	"comp3200/lib/network"
+	"fmt"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// RequestModel requests the model configuration from a parameter server, asking it to accept gradients compressed with a scheme.
+// It returns the scheme the server agreed to, which is None if the server does not understand the one asked for
+func RequestModel(msg messenger.Messenger, scheme Scheme) (network.NetworkConfig, Scheme, error) {
+	var config network.NetworkConfig
+	reply, err := msg.Request(messenger.ModelRequest, scheme.String())
+	if err != nil {
+		return config, None, err
+	}
+
+	var accepted string
+	err = reply.Decode(&config, &accepted)
+	if err != nil {
+		return config, None, err
+	}
+
+	agreed, err := ParseScheme(accepted)
+	if err != nil {
+		return config, None, err
+	}
+	return config, agreed, nil
+}
+
+// Negotiate returns the scheme a parameter server accepts in reply to a model request
+func Negotiate(request messenger.Envelope) Scheme {
+	var name string
+	err := request.Decode(&name)
+	if err != nil {
+		return None
+	}
+
+	scheme, err := ParseScheme(name)
+	if err != nil {
+		return None
+	}
+	return scheme
+}
+
+// SendDeltas sends weight and bias deltas as an update, compressing them if compressor is not nil.
+// version is the version of the parameters the deltas were computed on, or 0 if the server does not version its parameters
+func SendDeltas(msg messenger.Messenger, compressor *Compressor, version uint64, weights []mat.Dense, biases []mat.VecDense) error {
+	if compressor == nil || !compressor.Scheme().Compressed() {
+		return msg.Send(messenger.ParameterUpdate, version, weights, biases)
+	}
+	return msg.Send(messenger.ParameterUpdate, version, compressor.Compress(network.FlattenParameters(weights, biases)))
+}
+
+// SendSection sends the deltas of a section of the flattened parameters as an update, compressing them if compressor is not nil.
+// version is the version of the section the deltas were computed on
+func SendSection(msg messenger.Messenger, compressor *Compressor, version uint64, section []float64) error {
+	if compressor == nil || !compressor.Scheme().Compressed() {
+		return msg.Send(messenger.ParameterUpdate, version, section)
+	}
+	return msg.Send(messenger.ParameterUpdate, version, compressor.Compress(section))
+}
+
+// ReceiveDeltas decodes the version and the weight and bias deltas of an update sent by SendDeltas with the negotiated scheme.
+// Deltas that do not have the shape of the model are rejected, so that a malformed update cannot crash the receiver
+func ReceiveDeltas(update messenger.Envelope, scheme Scheme, model *network.Network) (uint64, []mat.Dense, []mat.VecDense, error) {
+	var version uint64
+	var weights []mat.Dense
+	var biases []mat.VecDense
+	if !scheme.Compressed() {
+		err := update.Decode(&version, &weights, &biases)
+		if err == nil {
+			err = sameShape(weights, biases, model)
+		}
+		return version, weights, biases, err
+	}
+
+	var g Gradient
+	err := update.Decode(&version, &g)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	weights, biases = model.ZeroedParameters()
+	flat, err := g.Decompress(len(network.FlattenParameters(weights, biases)))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	network.UnflattenParameters(flat, weights, biases)
+	return version, weights, biases, nil
+}
+
+// sameShape returns an error unless weights and biases have the shape of the parameters of model
+func sameShape(weights []mat.Dense, biases []mat.VecDense, model *network.Network) error {
+	w, b := model.ZeroedParameters()
+	if len(weights) != len(w) || len(biases) != len(b) {
+		return fmt.Errorf("deltas have %d weight matrices and %d bias vectors, model has %d layers", len(weights), len(biases), len(w))
+	}
+	for i := range w {
+		rows, cols := w[i].Dims()
+		r, c := weights[i].Dims()
+		if r != rows || c != cols || biases[i].Len() != b[i].Len() {
+			return fmt.Errorf("deltas of layer %d are %dx%d and %d, model has %dx%d and %d", i, r, c, biases[i].Len(), rows, cols, b[i].Len())
+		}
+	}
+	return nil
+}
+
+// ReceiveSection decodes the version and the deltas of an update sent by SendSection with the negotiated scheme,
+// rejecting a section that does not have length elements
+func ReceiveSection(update messenger.Envelope, scheme Scheme, length int) (uint64, []float64, error) {
+	var version uint64
+	var section []float64
+	if !scheme.Compressed() {
+		err := update.Decode(&version, &section)
+		if err == nil && len(section) != length {
+			err = fmt.Errorf("section has %d elements, expected %d", len(section), length)
+		}
+		return version, section, err
+	}
+
+	var g Gradient
+	err := update.Decode(&version, &g)
+	if err != nil {
+		return 0, nil, err
+	}
+	section, err = g.Decompress(length)
+	return version, section, err
+}
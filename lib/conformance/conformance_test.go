@@ -0,0 +1,412 @@
+package conformance
+
+import (
+	"comp3200/lib/async"
+	"comp3200/lib/compression"
+	"comp3200/lib/downpour"
+	"comp3200/lib/membership"
+	"comp3200/lib/messenger"
+	"comp3200/lib/network"
+	"comp3200/lib/synchronous"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// running is how long the replicas and clients of each cluster train before they leave, so that they do not slow down later tests
+const running = time.Second
+
+// patience is how long a test waits for a cluster to exchange the messages it checks for, long enough for a slow machine
+const patience = 30 * time.Second
+
+// Specifications of the parameter server and data server protocols, the clients of each are their mirrors
+var (
+	dataServer = newMachine("data server").
+			on(0, "rx HLO", 1).on(1, "tx RES", 2).
+			on(2, "rx PRT", 3).on(3, "tx RES", 5).
+			on(2, "rx DAT", 4).on(4, "tx RES", 2)
+
+	// A replica joins and then pulls and pushes in any order until it leaves, a primary streams a snapshot and then its updates to a backup.
+	// Anyone may ask for the members before anything else
+	downpourParameterServer = newMachine("downpour parameter server").
+				on(0, "rx HLO", 1).on(1, "tx RES", 2).
+				on(2, "rx MEM", 11).on(11, "tx RES", 2).
+				on(2, "rx MDL", 3).on(3, "tx RES", 4).
+				on(4, "rx JON", 5).on(5, "tx RES", 6).
+				on(6, "rx REQ", 7).on(7, "tx RES", 6).
+				on(6, "rx UPD", 6).
+				on(6, "rx LEV", 8).on(8, "tx RES", 9).
+				on(2, "rx SNP", 10).on(10, "rx RPL", 10)
+
+	// A Hogwild worker pulls before every push
+	asyncParameterServer = newMachine("async parameter server").
+				on(0, "rx HLO", 1).on(1, "tx RES", 2).
+				on(2, "rx MDL", 3).on(3, "tx RES", 4).
+				on(4, "rx REQ", 5).on(5, "tx RES", 6).
+				on(6, "rx UPD", 4)
+
+	// A synchronous client joins and then waits for the continue signal after every push until it leaves, as does an SSP client
+	syncParameterServer = newMachine("sync parameter server").
+				on(0, "rx HLO", 1).on(1, "tx RES", 2).
+				on(2, "rx MEM", 11).on(11, "tx RES", 2).
+				on(2, "rx MDL", 3).on(3, "tx RES", 4).
+				on(4, "rx JON", 5).on(5, "tx RES", 6).
+				on(6, "rx REQ", 7).on(7, "tx RES", 8).
+				on(8, "rx UPD", 9).on(9, "tx CON", 6).
+				on(6, "rx LEV", 10).on(10, "tx RES", 12)
+)
+
+// synthetic returns training data of n random records with two classes
+func synthetic(n int) *network.Data {
+	data := &network.Data{}
+	for i := 0; i < n; i++ {
+		input := mat.NewVecDense(4, []float64{rand.Float64(), rand.Float64(), rand.Float64(), rand.Float64()})
+		data.Train = append(data.Train, network.NewRecord(*input, i%2))
+	}
+	data.Test = data.Train[:20]
+	return data
+}
+
+func model() *network.Network {
+	return network.NewNetwork().WithLayer(4, 8, "sigmoid").WithLayer(8, 10, "softmax").WithLearningRate(0.1)
+}
+
+// clusters counts the clusters started, so that none reuses the names of a cluster left running by an earlier test
+var clusters int
+
+// cluster returns a function that names the servers of a new cluster and one that gives their addresses
+func cluster(algorithm string) (func(role string) string, func(role string) string) {
+	clusters++
+	prefix := fmt.Sprintf("%s%d-", algorithm, clusters)
+	name := func(role string) string {
+		return prefix + role
+	}
+	address := func(role string) string {
+		return messenger.MemoryScheme + name(role)
+	}
+	return name, address
+}
+
+// expectation is a struct that represents a message the server or clients of a cluster must see at least N times
+type expectation struct {
+	Server  string
+	Spec    *machine
+	Client  bool
+	Message string
+	N       int
+}
+
+// waitFor waits until every expectation has been met, failing the test if they are not all met within patience
+func waitFor(t *testing.T, capture *capture, expectations ...expectation) {
+	var missing expectation
+	met := func(conns map[uint64][]messenger.TraceEvent) bool {
+		for _, e := range expectations {
+			server, client, _ := count(conns, e.Server, e.Spec)
+			counts := server
+			if e.Client {
+				counts = client
+			}
+			if counts[e.Message] < e.N {
+				missing = e
+				return false
+			}
+		}
+		return true
+	}
+	if !capture.until(met) {
+		side := missing.Server
+		if missing.Client {
+			side += " clients"
+		}
+		t.Errorf("%s did not see %q %d times within %s", side, missing.Message, missing.N, patience)
+	}
+}
+
+// sees expects the server of a cluster to see a message at least n times
+func sees(server string, spec *machine, message string, n int) expectation {
+	return expectation{server, spec, false, message, n}
+}
+
+// clientsSee expects the clients of the server of a cluster to see a message at least n times between them
+func clientsSee(server string, spec *machine, message string, n int) expectation {
+	return expectation{server, spec, true, message, n}
+}
+
+func TestDownpourConformance(t *testing.T) {
+	name, address := cluster("downpour")
+	capture := startCapture()
+
+	go downpour.LaunchParameterShard(address("backup"), model(), 0, 2, "", downpour.NoStalenessPolicy, downpour.SGDOptimiser, "")
+	go downpour.LaunchParameterShard(address("shard0"), model(), 0, 2, address("backup"), downpour.StalenessPolicy{Name: downpour.ScaleStale}, downpour.Optimiser{Name: downpour.Adagrad, LearningRate: 0.1}, "")
+	go downpour.LaunchParameterShard(address("shard1"), model(), 1, 2, "", downpour.StalenessPolicy{Name: downpour.StaleMomentum, Momentum: 0.9}, downpour.SGDOptimiser, "")
+	go downpour.LaunchDataServer(address("data"))
+	downpour.ProvisionData([]string{address("data")}, synthetic(800))
+	go downpour.LaunchModelReplica(address("data"), nil, []string{address("shard0"), address("shard1")}, []string{address("backup"), ""}, 20, 5, 5, compression.None, running)
+	go downpour.LaunchModelReplica("", synthetic(800), []string{address("shard0"), address("shard1")}, nil, 20, 5, 5, compression.None, running/4)
+
+	expectations := []expectation{
+		sees(name("data"), dataServer, "rx PRT", 1),
+		sees(name("data"), dataServer, "rx DAT", 1),
+		clientsSee(name("data"), dataServer, "rx RES", 3),
+		sees(name("backup"), downpourParameterServer, "rx SNP", 1),
+		sees(name("backup"), downpourParameterServer, "rx RPL", 2),
+	}
+	for _, shard := range []string{"shard0", "shard1"} {
+		expectations = append(expectations,
+			sees(name(shard), downpourParameterServer, "rx UPD", 2),
+			clientsSee(name(shard), downpourParameterServer, "rx RES", 3),
+			sees(name(shard), downpourParameterServer, "rx LEV", 1))
+	}
+	waitFor(t, capture, expectations...)
+
+	conns := capture.connections(t)
+	check(t, conns, name("data"), dataServer)
+	for _, server := range []string{"shard0", "shard1", "backup"} {
+		check(t, conns, name(server), downpourParameterServer)
+	}
+}
+
+// TestDownpourLocalData checks that a replica started without a data server trains on the data it was given, as a replica
+// started from the command line without -data does
+func TestDownpourLocalData(t *testing.T) {
+	name, address := cluster("local")
+	capture := startCapture()
+	go downpour.LaunchParameterShard(address("parameter"), model(), 0, 1, "", downpour.NoStalenessPolicy, downpour.SGDOptimiser, "")
+	go downpour.LaunchModelReplica("", synthetic(400), []string{address("parameter")}, []string{""}, 20, 5, 5, compression.None, running/4)
+
+	waitFor(t, capture,
+		sees(name("parameter"), downpourParameterServer, "rx UPD", 2),
+		sees(name("parameter"), downpourParameterServer, "rx LEV", 1))
+	check(t, capture.connections(t), name("parameter"), downpourParameterServer)
+}
+
+func TestAsyncConformance(t *testing.T) {
+	name, address := cluster("async")
+	capture := startCapture()
+	go async.LaunchParameterServer(address("parameter"), model())
+	go async.LaunchWorker(address("parameter"), synthetic(400), compression.None)
+	go async.LaunchWorker(address("parameter"), synthetic(400), compression.None)
+
+	waitFor(t, capture,
+		sees(name("parameter"), asyncParameterServer, "rx UPD", 2),
+		clientsSee(name("parameter"), asyncParameterServer, "tx UPD", 2))
+	check(t, capture.connections(t), name("parameter"), asyncParameterServer)
+}
+
+func TestSyncConformance(t *testing.T) {
+	name, address := cluster("sync")
+	capture := startCapture()
+	go synchronous.LaunchSynchronousParameterServer(address("parameter"), 2, 0, 0, model())
+	go synchronous.LaunchClient(address("parameter"), synthetic(400), compression.None, running)
+	go synchronous.LaunchClient(address("parameter"), synthetic(400), compression.None, running)
+
+	waitFor(t, capture,
+		sees(name("parameter"), syncParameterServer, "tx CON", 4),
+		clientsSee(name("parameter"), syncParameterServer, "rx CON", 4))
+	check(t, capture.connections(t), name("parameter"), syncParameterServer)
+}
+
+func TestStaleSyncConformance(t *testing.T) {
+	name, address := cluster("ssp")
+	capture := startCapture()
+	go synchronous.LaunchStaleSynchronousParameterServer(address("parameter"), 1, model())
+	go synchronous.LaunchClient(address("parameter"), synthetic(400), compression.None, running)
+	go synchronous.LaunchClient(address("parameter"), synthetic(400), compression.None, running)
+
+	waitFor(t, capture,
+		sees(name("parameter"), syncParameterServer, "tx CON", 4),
+		clientsSee(name("parameter"), syncParameterServer, "rx CON", 4))
+	check(t, capture.connections(t), name("parameter"), syncParameterServer)
+}
+
+// TestSyncMembership checks that the barrier waits for a client that joins after training has started and stops waiting
+// for it once it leaves
+func TestSyncMembership(t *testing.T) {
+	name, address := cluster("membership")
+	capture := startCapture()
+	go synchronous.LaunchSynchronousParameterServer(address("parameter"), 2, 0, 0, model())
+	go synchronous.LaunchClient(address("parameter"), synthetic(400), compression.None, 2*running)
+	go synchronous.LaunchClient(address("parameter"), synthetic(400), compression.None, 2*running)
+	waitFor(t, capture, sees(name("parameter"), syncParameterServer, "tx CON", 2))
+	go synchronous.LaunchClient(address("parameter"), synthetic(400), compression.None, running/4)
+
+	var members []membership.Member
+	joined := eventually(func() bool {
+		msg, err := messenger.Connect(address("parameter"))
+		if err != nil {
+			return false
+		}
+		defer msg.Close()
+		members, err = membership.Members(msg)
+		return err == nil && len(members) == 3
+	})
+	if !joined {
+		t.Errorf("%d members while three clients were training, expected 3: %v", len(members), members)
+	}
+
+	// Rounds must carry on for the clients that stayed once the third has left
+	after := 0
+	carriedOn := capture.until(func(conns map[uint64][]messenger.TraceEvent) bool {
+		after = continuedAfterLeave(conns, name("parameter"))
+		return after >= 4
+	})
+	if !carriedOn {
+		t.Errorf("%d continue signals were sent after a client left, expected at least 4", after)
+	}
+
+	conns := capture.connections(t)
+	check(t, conns, name("parameter"), syncParameterServer)
+	server, _, _ := count(conns, name("parameter"), syncParameterServer)
+	if server["rx JON"] < 3 {
+		t.Errorf("parameter server saw %d joins, expected at least 3", server["rx JON"])
+	}
+}
+
+// continuedAfterLeave returns how many continue signals a server sent after the first leave request it received
+func continuedAfterLeave(conns map[uint64][]messenger.TraceEvent, server string) int {
+	var left time.Time
+	var continued []time.Time
+	for _, events := range conns {
+		if events[0].Local != server {
+			continue
+		}
+		for _, event := range events {
+			if event.Kind == messenger.Leave && (left.IsZero() || event.Time.Before(left)) {
+				left = event.Time
+			} else if event.Kind == messenger.Continue {
+				continued = append(continued, event.Time)
+			}
+		}
+	}
+
+	after := 0
+	for _, at := range continued {
+		if !left.IsZero() && at.After(left) {
+			after++
+		}
+	}
+	return after
+}
+
+// idleMember joins a synchronous parameter server as a client that never pushes, returning its membership and a function to close it
+func idleMember(t *testing.T, address string) (membership.Member, func() error) {
+	msg, err := messenger.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = compression.RequestModel(msg, compression.None)
+	if err != nil {
+		t.Fatal(err)
+	}
+	member, err := membership.Join(msg, "idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return member, msg.Close
+}
+
+// testSyncStraggler checks that rounds carry on without a member that never pushes and that every round logs it as dropped
+func testSyncStraggler(t *testing.T, algorithm string, backups int, barrierTimeout time.Duration) {
+	name, address := cluster(algorithm)
+	logs := &capture{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+	capture := startCapture()
+
+	go synchronous.LaunchSynchronousParameterServer(address("parameter"), 3, backups, barrierTimeout, model())
+	idle, stop := idleMember(t, address("parameter"))
+	defer stop()
+	go synchronous.LaunchClient(address("parameter"), synthetic(400), compression.None, running)
+	go synchronous.LaunchClient(address("parameter"), synthetic(400), compression.None, running)
+
+	waitFor(t, capture,
+		sees(name("parameter"), syncParameterServer, "tx CON", 2),
+		clientsSee(name("parameter"), syncParameterServer, "rx CON", 2))
+	check(t, capture.connections(t), name("parameter"), syncParameterServer)
+
+	dropped := fmt.Sprintf("dropped,0,%d\n", idle.ID)
+	logged := eventually(func() bool {
+		logs.mutex.Lock()
+		defer logs.mutex.Unlock()
+		return strings.Contains(logs.buffer.String(), dropped)
+	})
+	if !logged {
+		t.Errorf("the first round did not log dropping member %d", idle.ID)
+	}
+}
+
+func TestSyncBackupClients(t *testing.T) {
+	testSyncStraggler(t, "backup", 1, 0)
+}
+
+func TestSyncBarrierTimeout(t *testing.T) {
+	testSyncStraggler(t, "timeout", 0, running/20)
+}
+
+// TestSyncFirstRoundWaits checks that the first round waits for every client the server was started with, even when it times out
+func TestSyncFirstRoundWaits(t *testing.T) {
+	name, address := cluster("first")
+	capture := startCapture()
+	timeout := running / 20
+	go synchronous.LaunchSynchronousParameterServer(address("parameter"), 2, 0, timeout, model())
+	go synchronous.LaunchClient(address("parameter"), synthetic(400), compression.None, running)
+	waitFor(t, capture, sees(name("parameter"), syncParameterServer, "rx UPD", 1))
+
+	// Several timeouts pass with only one client joined
+	time.Sleep(5 * timeout)
+	conns, err := capture.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _, _ := count(conns, name("parameter"), syncParameterServer)
+	if server["tx CON"] > 0 {
+		t.Errorf("the first round finished with one of two clients joined")
+	}
+
+	go synchronous.LaunchClient(address("parameter"), synthetic(400), compression.None, running)
+	waitFor(t, capture, sees(name("parameter"), syncParameterServer, "tx CON", 2))
+	check(t, capture.connections(t), name("parameter"), syncParameterServer)
+}
+
+// TestSyncDoubleJoin checks that a connection that joins twice is refused rather than leaving a member behind that never pushes
+func TestSyncDoubleJoin(t *testing.T) {
+	_, address := cluster("rejoin")
+	go synchronous.LaunchSynchronousParameterServer(address("parameter"), 1, 0, 0, model())
+	_, stop := idleMember(t, address("parameter"))
+	defer stop()
+
+	msg, err := messenger.Connect(address("parameter"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer msg.Close()
+	_, err = membership.Join(msg, "twice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = membership.Join(msg, "twice")
+	if err == nil {
+		t.Fatal("joined twice on one connection")
+	}
+
+	// The server drops the connection, and with it the first membership, leaving only the idle member
+	var members []membership.Member
+	left := eventually(func() bool {
+		msg, err := messenger.Connect(address("parameter"))
+		if err != nil {
+			return false
+		}
+		defer msg.Close()
+		members, err = membership.Members(msg)
+		return err == nil && len(members) == 1 && members[0].Name == "idle"
+	})
+	if !left {
+		t.Errorf("members after joining twice are %v, expected only the idle member", members)
+	}
+}
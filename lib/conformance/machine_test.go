@@ -0,0 +1,165 @@
+package conformance
+
+import (
+	"bytes"
+	"comp3200/lib/messenger"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// machine is a state machine that specifies the messages one end of a connection may send and receive, starting in state 0.
+// Transitions are labelled "tx KIND" or "rx KIND", and a connection may stop in any state as clusters are never shut down
+type machine struct {
+	name        string
+	transitions map[int]map[string]int
+}
+
+func newMachine(name string) *machine {
+	return &machine{name: name, transitions: make(map[int]map[string]int)}
+}
+
+// on adds a transition to the machine
+func (m *machine) on(from int, message string, to int) *machine {
+	if m.transitions[from] == nil {
+		m.transitions[from] = make(map[string]int)
+	}
+	m.transitions[from][message] = to
+	return m
+}
+
+// mirror returns the machine of the other end of the connection, which sends what this end receives and receives what it sends
+func (m *machine) mirror(name string) *machine {
+	mirrored := newMachine(name)
+	for from, transitions := range m.transitions {
+		for message, to := range transitions {
+			direction, kind := message[:2], message[3:]
+			if direction == messenger.DirectionSent {
+				direction = messenger.DirectionReceived
+			} else {
+				direction = messenger.DirectionSent
+			}
+			mirrored.on(from, direction+" "+kind, to)
+		}
+	}
+	return mirrored
+}
+
+// run checks the messages of one end of a connection against the machine, counting each message into counts
+func (m *machine) run(events []messenger.TraceEvent, counts map[string]int) error {
+	state := 0
+	var seen []string
+	for _, event := range events {
+		if event.Kind == messenger.Heartbeat {
+			continue
+		}
+		message := event.Direction + " " + string(event.Kind)
+		seen = append(seen, message)
+
+		next, ok := m.transitions[state][message]
+		if !ok {
+			// Only the messages leading up to the violation are shown, as a long run sees thousands
+			recent := seen[:len(seen)-1]
+			if len(recent) > 8 {
+				recent = recent[len(recent)-8:]
+			}
+			return fmt.Errorf("%s: %q is not allowed in state %d after %d messages ending %s", m.name, message, state, len(seen)-1, strings.Join(recent, ", "))
+		}
+		state = next
+		counts[message]++
+	}
+	return nil
+}
+
+// capture is a struct that records the trace of every messenger in the process while a cluster runs
+type capture struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (c *capture) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.buffer.Write(p)
+}
+
+func startCapture() *capture {
+	c := &capture{}
+	messenger.StartTracing(c, false)
+	return c
+}
+
+// snapshot returns the events of every connection end captured so far, in the order they happened
+func (c *capture) snapshot() (map[uint64][]messenger.TraceEvent, error) {
+	c.mutex.Lock()
+	events, err := messenger.ReadTrace(bytes.NewReader(c.buffer.Bytes()))
+	c.mutex.Unlock()
+
+	conns := make(map[uint64][]messenger.TraceEvent)
+	for _, event := range events {
+		conns[event.Conn] = append(conns[event.Conn], event)
+	}
+	return conns, err
+}
+
+// until polls the events captured so far until done returns true of them, returning false if it has not within patience
+func (c *capture) until(done func(map[uint64][]messenger.TraceEvent) bool) bool {
+	return eventually(func() bool {
+		conns, err := c.snapshot()
+		return err == nil && done(conns)
+	})
+}
+
+// eventually polls done until it returns true, returning false if it has not within patience
+func eventually(done func() bool) bool {
+	for deadline := time.Now().Add(patience); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if done() {
+			return true
+		}
+	}
+	return false
+}
+
+// connections stops capturing and returns the events of every connection end, in the order they happened
+func (c *capture) connections(t *testing.T) map[uint64][]messenger.TraceEvent {
+	messenger.StopTracing()
+	conns, err := c.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conns
+}
+
+// count runs every connection end to or from a server against the machine of that server or its mirror and returns how
+// many of each message the ends of each side saw and the conversations that broke the machine. Connections of clusters
+// left running by earlier tests are ignored
+func count(conns map[uint64][]messenger.TraceEvent, server string, spec *machine) (map[string]int, map[string]int, []error) {
+	client := spec.mirror(spec.name + " client")
+	serverCounts, clientCounts := make(map[string]int), make(map[string]int)
+	var errs []error
+	for _, events := range conns {
+		var err error
+		switch {
+		case events[0].Local == server:
+			err = spec.run(events, serverCounts)
+		case events[0].Peer == messenger.MemoryScheme+server:
+			err = client.run(events, clientCounts)
+		default:
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return serverCounts, clientCounts, errs
+}
+
+// check fails the test for every connection end to or from a server that breaks the machine of that server or its mirror
+func check(t *testing.T, conns map[uint64][]messenger.TraceEvent, server string, spec *machine) {
+	_, _, errs := count(conns, server, spec)
+	for _, err := range errs {
+		t.Error(err)
+	}
+}
@@ -1,8 +1,4 @@
 package lib
 
-import "time"
-
 const MiniBatchSize int = 20
-const SimulatingLatency bool = false
 const LogMessages bool = false
-const Latency time.Duration = 5
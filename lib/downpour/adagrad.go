@@ -0,0 +1,107 @@
+package downpour
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Optimisers
+const (
+	PlainSGD = "sgd"
+	Adagrad  = "adagrad"
+)
+
+// defaultAdagradRate is the learning rate Adagrad uses when none is given
+const defaultAdagradRate = 0.01
+
+// adagradEpsilon keeps Adagrad from dividing by zero for parameters that have had no gradient yet
+const adagradEpsilon = 1e-8
+
+// Optimiser is a struct that represents how a parameter server turns the updates it applies into steps of the parameters
+type Optimiser struct {
+	Name string
+
+	// LearningRate is the learning rate of Adagrad, which replaces that of the model
+	LearningRate float64
+}
+
+// SGDOptimiser steps the parameters by each update scaled by the learning rate of the model
+var SGDOptimiser = Optimiser{Name: PlainSGD}
+
+// ParseOptimiser parses an optimiser of the form "sgd", "adagrad" or "adagrad:<learning rate>"
+func ParseOptimiser(s string) (Optimiser, error) {
+	parts := strings.SplitN(s, ":", 2)
+	optimiser := Optimiser{Name: parts[0]}
+	switch parts[0] {
+	case PlainSGD:
+		if len(parts) == 1 {
+			return optimiser, nil
+		}
+	case Adagrad:
+		optimiser.LearningRate = defaultAdagradRate
+		if len(parts) == 1 {
+			return optimiser, nil
+		}
+		rate, err := strconv.ParseFloat(parts[1], 64)
+		if err == nil && rate > 0 {
+			optimiser.LearningRate = rate
+			return optimiser, nil
+		}
+	}
+	return Optimiser{}, fmt.Errorf("unknown optimiser %q, expected sgd or adagrad:<learning rate>", s)
+}
+
+func (o Optimiser) String() string {
+	if o.Name == Adagrad {
+		return o.Name + ":" + strconv.FormatFloat(o.LearningRate, 'g', -1, 64)
+	}
+	return o.Name
+}
+
+// optimise turns the deltas of a layer into those that the model applies scaled by its own learning rate.
+// Adagrad adds the square of each gradient to its parameter's accumulator and divides the gradient by the root of the accumulator.
+// The mutex of the layer must be held
+func (ps *ParameterServer) optimise(l *layer, deltas []float64) {
+	if ps.optimiser.Name != Adagrad {
+		return
+	}
+
+	if l.accumulators == nil {
+		l.accumulators = make([]float64, len(deltas))
+	}
+
+	// The model scales what it applies by its learning rate, which Adagrad's replaces
+	rate := ps.optimiser.LearningRate / ps.model.Config.LearningRate
+	for i, g := range deltas {
+		if g == 0 {
+			continue
+		}
+		l.accumulators[i] += g * g
+		deltas[i] = rate * g / (math.Sqrt(l.accumulators[i]) + adagradEpsilon)
+	}
+}
+
+// accumulators returns Adagrad's accumulators of every parameter, or nil if there are none yet. Every layer must be locked
+func (ps *ParameterServer) accumulators() []float64 {
+	if ps.optimiser.Name != Adagrad {
+		return nil
+	}
+
+	accumulators := make([]float64, ps.length())
+	for _, l := range ps.layers {
+		copy(accumulators[l.offset:], l.accumulators)
+	}
+	return accumulators
+}
+
+// setAccumulators replaces Adagrad's accumulators of every parameter, nil starting them all from zero. Every layer must be locked
+func (ps *ParameterServer) setAccumulators(accumulators []float64) {
+	for _, l := range ps.layers {
+		l.accumulators = nil
+		if accumulators != nil {
+			l.accumulators = append([]float64(nil), accumulators[l.offset:l.offset+l.length]...)
+		}
+	}
+}
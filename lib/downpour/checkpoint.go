@@ -0,0 +1,102 @@
+package downpour
+
+import (
+	"encoding/gob"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// CheckpointInterval is the time between the checkpoints a parameter server saves
+var CheckpointInterval = time.Minute
+
+// checkpoint is a struct that represents the state a parameter server saves to restart from, including Adagrad's accumulators
+type checkpoint struct {
+	Weights      []mat.Dense
+	Biases       []mat.VecDense
+	Accumulators []float64
+}
+
+// saveCheckpoints saves a checkpoint to path every CheckpointInterval, replacing the last one
+func (ps *ParameterServer) saveCheckpoints(path string) {
+	for {
+		time.Sleep(CheckpointInterval)
+
+		// Holding every lock ensures the accumulators match the parameters
+		ps.lockLayers()
+		weights, biases := ps.model.Parameters()
+		c := checkpoint{weights, biases, ps.accumulators()}
+		ps.unlockLayers()
+
+		err := writeCheckpoint(path, c)
+		if err != nil {
+			log.Println("ERR: could not save checkpoint", err)
+		}
+	}
+}
+
+// writeCheckpoint writes a checkpoint to a temporary file and then renames it over path, so that a crash never leaves half a checkpoint
+func writeCheckpoint(path string, c checkpoint) error {
+	temporary := path + ".tmp"
+	f, err := os.Create(temporary)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(c)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temporary)
+		return err
+	}
+	return os.Rename(temporary, path)
+}
+
+// restoreCheckpoint sets the parameters and accumulators from the checkpoint at path, returning false if there is none yet
+func (ps *ParameterServer) restoreCheckpoint(path string) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	var c checkpoint
+	err = gob.NewDecoder(f).Decode(&c)
+	if err != nil {
+		return false, fmt.Errorf("reading checkpoint %s: %w", path, err)
+	}
+
+	// A checkpoint of another model would fail later in ways that are harder to understand
+	weights, biases := ps.model.ZeroedParameters()
+	if len(c.Weights) != len(weights) || len(c.Biases) != len(biases) {
+		return false, fmt.Errorf("checkpoint %s has %d layers, the model has %d", path, len(c.Weights), len(weights))
+	}
+	length := 0
+	for i := range weights {
+		r, cols := weights[i].Dims()
+		cr, ccols := c.Weights[i].Dims()
+		if r != cr || cols != ccols || biases[i].Len() != c.Biases[i].Len() {
+			return false, fmt.Errorf("checkpoint %s does not match the shape of layer %d of the model", path, i)
+		}
+		length += r*cols + biases[i].Len()
+	}
+	if c.Accumulators != nil && len(c.Accumulators) != length {
+		return false, fmt.Errorf("checkpoint %s has %d accumulators for %d parameters", path, len(c.Accumulators), length)
+	}
+
+	ps.lockLayers()
+	ps.model.SetParameters(c.Weights, c.Biases)
+	for j, l := range ps.layers {
+		w, b := ps.model.LayerParameters(j)
+		l.published.Store(l.view().replaced(ps.version, flatten(w, b)))
+	}
+	ps.setAccumulators(c.Accumulators)
+	ps.unlockLayers()
+	return true, nil
+}
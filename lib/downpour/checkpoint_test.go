@@ -0,0 +1,151 @@
+package downpour
+
+import (
+	"comp3200/lib/messenger"
+	"comp3200/lib/network"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAdagradCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "parameter.checkpoint")
+
+	model := network.NewNetwork().WithLayer(4, 3, "sigmoid").WithLayer(3, 2, "softmax").WithLearningRate(0.5)
+	ps := newParameterServer(model, 0, 1, NoStalenessPolicy, Optimiser{Name: Adagrad, LearningRate: 0.1})
+	before, _ := model.Parameters()
+
+	// Adagrad's first step of any parameter is its learning rate, whatever the size of the gradient
+	weights, biases := model.ZeroedParameters()
+	weights[0].Set(0, 0, 4)
+	weights[0].Set(1, 2, -0.25)
+	ps.update(0, 0, network.FlattenParameters(weights, biases), false)
+	after, _ := model.Parameters()
+	for _, step := range []float64{before[0].At(0, 0) - after[0].At(0, 0), after[0].At(1, 2) - before[0].At(1, 2)} {
+		if math.Abs(step-0.1) > 1e-6 {
+			t.Fatalf("first Adagrad step was %v, expected 0.1", step)
+		}
+	}
+
+	weights, biases = model.Parameters()
+	saved := ps.accumulators()
+	err = writeCheckpoint(path, checkpoint{weights, biases, saved})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newParameterServer(network.NewNetworkFromConfig(model.Config), 0, 1, NoStalenessPolicy, Optimiser{Name: Adagrad, LearningRate: 0.1})
+	ok, err := restored.restoreCheckpoint(path)
+	if err != nil || !ok {
+		t.Fatal("could not restore checkpoint", err)
+	}
+	w, b := restored.model.Parameters()
+	got, expected := network.FlattenParameters(w, b), network.FlattenParameters(weights, biases)
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("restored parameter %d is %v, saved %v", i, got[i], expected[i])
+		}
+	}
+	accumulators := restored.accumulators()
+	for i := range saved {
+		if accumulators[i] != saved[i] {
+			t.Fatalf("restored accumulator %d is %v, saved %v", i, accumulators[i], saved[i])
+		}
+	}
+	if accumulators[0] != 16 {
+		t.Fatalf("accumulator of a gradient of 4 is %v, expected 16", accumulators[0])
+	}
+
+	// A checkpoint of a different model is refused
+	other := newParameterServer(network.NewNetwork().WithLayer(4, 5, "sigmoid").WithLayer(5, 2, "softmax"), 0, 1, NoStalenessPolicy, SGDOptimiser)
+	_, err = other.restoreCheckpoint(path)
+	if err == nil {
+		t.Fatal("restored a checkpoint of a different model")
+	}
+
+	ok, err = restored.restoreCheckpoint(filepath.Join(dir, "missing"))
+	if ok || err != nil {
+		t.Fatal("restored a missing checkpoint", err)
+	}
+}
+
+// TestAdagradReplication checks that a backup keeps Adagrad's accumulators in step with its primary, so that it takes the same
+// steps as the primary would after a failover
+func TestAdagradReplication(t *testing.T) {
+	adagrad := Optimiser{Name: Adagrad, LearningRate: 0.1}
+	model := network.NewNetwork().WithLayer(4, 3, "sigmoid").WithLayer(3, 2, "softmax").WithLearningRate(0.5)
+	primary := newParameterServer(model, 0, 1, NoStalenessPolicy, adagrad)
+	backup := newParameterServer(network.NewNetworkFromConfig(model.Config), 0, 1, NoStalenessPolicy, SGDOptimiser)
+
+	// The primary has accumulated gradients before the backup connects, and carries on once it has
+	deltas := make([]float64, primary.length())
+	push := func(u int) {
+		for i := range deltas {
+			deltas[i] = float64(u*i%5) - 2
+		}
+		primary.update(0, 0, deltas, false)
+	}
+	push(1)
+	push(2)
+	client, server := net.Pipe()
+	go backup.handleConnection(messenger.NewMessenger(server))
+	go primary.stream(messenger.NewMessenger(client))
+	streaming := func() bool {
+		primary.lockLayers()
+		defer primary.unlockLayers()
+		return primary.backup != nil
+	}
+	for !streaming() {
+		time.Sleep(time.Millisecond)
+	}
+	push(3)
+	push(4)
+
+	// The backup is in step once it has applied the snapshot and both updates after it
+	applied := func() bool {
+		backup.lockLayers()
+		defer backup.unlockLayers()
+		return backup.version == 3
+	}
+	for deadline := time.Now().Add(5 * time.Second); !applied(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("backup did not apply the snapshot and updates")
+		}
+	}
+
+	// After failing over, the backup steps as the primary does
+	for i := range deltas {
+		deltas[i] = 1
+	}
+	primary.update(0, 0, deltas, false)
+	backup.update(0, 0, deltas, false)
+
+	backup.lockLayers()
+	defer backup.unlockLayers()
+	primary.lockLayers()
+	defer primary.unlockLayers()
+	expected, got := primary.accumulators(), backup.accumulators()
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("backup accumulator %d is %v, primary's is %v", i, got[i], expected[i])
+		}
+	}
+	weights, biases := primary.model.Parameters()
+	expected = network.FlattenParameters(weights, biases)
+	weights, biases = backup.model.Parameters()
+	got = network.FlattenParameters(weights, biases)
+	for i := range expected {
+		if math.Abs(got[i]-expected[i]) > 1e-12 {
+			t.Fatalf("backup parameter %d is %v, primary's is %v", i, got[i], expected[i])
+		}
+	}
+}
@@ -3,24 +3,32 @@ package downpour
 import (
 	"comp3200/lib/messenger"
 	"comp3200/lib/network"
+	"log"
 )
 
-// ProvisionData partitions data and sends to supplied addresses
-func ProvisionData(addresses []string) {
-	data := network.LoadData()
-	data.Test = nil
-
+// ProvisionData partitions the training data and sends to supplied addresses
+func ProvisionData(addresses []string, data *network.Data) {
 	partitionSize := len(data.Train) / len(addresses)
 	for i := 0; i < len(addresses); i++ {
 		start := i * partitionSize
 		end := start + partitionSize
 		partition := network.Data{Train: data.Train[start:end]}
-		sendPartition(addresses[i], partition)
+		err := sendPartition(addresses[i], partition)
+		if err != nil {
+			log.Println("ERR: could not provision", addresses[i], err)
+		}
 	}
 
 }
 
-func sendPartition(address string, partition network.Data) {
-	messenger := messenger.Connect(address)
-	messenger.SendInterface(partition)
+func sendPartition(address string, partition network.Data) error {
+	msg, err := messenger.Connect(address)
+	if err != nil {
+		return err
+	}
+	defer msg.Close()
+
+	// Wait for the data server to acknowledge the partition, closing straight after sending could lose it in flight
+	_, err = msg.Request(messenger.Partition, partition)
+	return err
 }
@@ -4,11 +4,11 @@ import (
 	"comp3200/lib"
 	"comp3200/lib/messenger"
 	"comp3200/lib/network"
+	"errors"
 	"log"
 	"math/rand"
 	"net"
-	"strconv"
-	"strings"
+	"sync"
 )
 
 // DataServer is a struct that represents a Downpour data server
@@ -17,8 +17,8 @@ type DataServer struct {
 	index       int
 }
 
-// Serve n mini-batches using a messenger
-func (ds *DataServer) serveMiniBatches(messenger messenger.Messenger, n int) {
+// Serve n mini-batches in reply to a request using a messenger
+func (ds *DataServer) serveMiniBatches(msg messenger.Messenger, request messenger.Envelope, n int) error {
 	var batches [][]network.Record
 	count := 0
 	for count < n {
@@ -33,61 +33,147 @@ func (ds *DataServer) serveMiniBatches(messenger messenger.Messenger, n int) {
 
 	// Otherwise serve the minibatches
 	// fmt.Println("Serving data")
-	messenger.SendInterface(batches)
+	err := msg.Reply(request, batches)
+	if err != nil {
+		return err
+	}
 
 	ds.index += count
+	return nil
 }
 
 // LaunchDataServer starts a data server on a specified address
 func LaunchDataServer(address string) {
-	l, err := net.Listen("tcp4", address)
+	l, err := messenger.Listen(address)
 
 	if err != nil {
 		log.Println("ERR:", err)
+		return
 	}
 
 	ds := DataServer{}
 
+	messengers := make(chan messenger.Messenger)
+	go acceptAll(l, messengers)
+
 	// Initially receive all data
 	log.Println("Waiting to be assigned data partition...")
 	var data network.Data
-	conn, err := l.Accept()
-	msg := messenger.NewMessenger(conn)
-	msg.ReceiveInterface(&data)
+	for {
+		msg, ok := <-messengers
+		if !ok {
+			return
+		}
+		err := receivePartition(msg, &data)
+		msg.Close()
+		if err == nil {
+			break
+		}
+		log.Println("ERR: could not receive data partition", err)
+	}
 
 	ds.miniBatches = data.GetMiniBatches(lib.MiniBatchSize)
 	log.Println("Assigned data partition")
 
-	// Wait for a model replica to connect
-	log.Println("Waiting for model replica...")
-	conn, _ = l.Accept()
-	msg = messenger.NewMessenger(conn)
+	// Serve one model replica at a time, waiting for another if it disconnects
+	for {
+		log.Println("Waiting for model replica...")
+		msg, ok := <-messengers
+		if !ok {
+			return
+		}
+		err := ds.serve(msg)
+		if errors.Is(err, messenger.ErrPeerClosed) {
+			log.Println("Model replica disconnected")
+		} else if errors.Is(err, messenger.ErrTimeout) {
+			log.Println("Model replica timed out, assuming it is dead")
+		} else {
+			log.Println("ERR:", err)
+		}
+	}
+}
+
+// acceptAll accepts connections on l and passes each on to messengers once its handshake is done. Handshakes run
+// concurrently, so a peer that connects and says nothing does not hold up the rest. messengers is closed once l fails
+func acceptAll(l net.Listener, messengers chan<- messenger.Messenger) {
+	var handshakes sync.WaitGroup
+	defer func() {
+		handshakes.Wait()
+		close(messengers)
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Println("ERR:", err)
+			return
+		}
+		handshakes.Add(1)
+		go func() {
+			defer handshakes.Done()
+			msg, err := messenger.Accept(conn)
+			if err != nil {
+				log.Println("ERR: handshake failed", err)
+				return
+			}
+			messengers <- msg
+		}()
+	}
+}
+
+// serve handles requests from a model replica until an error occurs
+func (ds *DataServer) serve(msg messenger.Messenger) error {
+	defer msg.Close()
 	for {
 		// Wait for a partition request telling us how many minibatches to send
-		n := ds.waitForRequest(msg)
+		request, n, err := ds.waitForRequest(msg)
+		if err != nil {
+			return err
+		}
 
 		if n > 0 {
 
 			// Serve request
-			ds.serveMiniBatches(msg, n)
+			err = ds.serveMiniBatches(msg, request, n)
+			if err != nil {
+				return err
+			}
 		}
 	}
 }
 
 // Wait for a data request to come in before continuing
-func (ds *DataServer) waitForRequest(messenger messenger.Messenger) int {
+func (ds *DataServer) waitForRequest(msg messenger.Messenger) (messenger.Envelope, int, error) {
 	// fmt.Println("Waiting for data request")
-	var msg string
-	messenger.ReceiveMessage(&msg)
+	request, err := msg.Receive()
+	if err != nil {
+		return request, 0, err
+	}
 
-	parts := strings.Split(msg, " ")
+	if request.Kind != messenger.DataRequest {
+		return request, 0, messenger.Unexpected(request)
+	}
 
-	// If message reads REQ then exit and serve the partition
-	if parts[0] == "REQ" {
-		count, _ := strconv.ParseInt(parts[1], 10, 32)
-		// fmt.Println("Received data request for", count, "batches")
-		return int(count)
+	var count int
+	err = request.Decode(&count)
+	// fmt.Println("Received data request for", count, "batches")
+	return request, count, err
+}
+
+// receivePartition receives the data partition a provisioner sends and acknowledges it
+func receivePartition(msg messenger.Messenger, data *network.Data) error {
+	request, err := msg.Receive()
+	if err != nil {
+		return err
 	}
 
-	return 0
+	if request.Kind != messenger.Partition {
+		return messenger.Unexpected(request)
+	}
+
+	err = request.Decode(data)
+	if err != nil {
+		return err
+	}
+	return msg.Reply(request)
 }
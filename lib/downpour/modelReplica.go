@@ -2,12 +2,11 @@ package downpour
 
 import (
 	"comp3200/lib"
+	"comp3200/lib/compression"
 	"comp3200/lib/messenger"
 	"comp3200/lib/network"
 	"log"
-	"strconv"
-
-	"gonum.org/v1/gonum/mat"
+	"time"
 )
 
 // ModelReplica is a struct that represents a Downpour model replica
@@ -17,26 +16,34 @@ type ModelReplica struct {
 	push  int
 }
 
-// LaunchModelReplica starts a model replica with the specified parameters
-func LaunchModelReplica(dataAddress string, parameterAddress string, requestSize int, fetch int, push int) {
+// LaunchModelReplica starts a model replica with the specified parameters, training on data if there is no data server at dataAddress.
+// parameterAddresses lists each parameter server shard in order and backupAddresses optionally lists the backup server of each shard.
+// Pushed deltas are compressed with scheme. The replica leaves once it has trained for trainFor, or trains for as long as it can if trainFor is zero
+func LaunchModelReplica(dataAddress string, data *network.Data, parameterAddresses []string, backupAddresses []string, requestSize int, fetch int, push int, scheme compression.Scheme, trainFor time.Duration) {
+	start := time.Now()
 	mr := ModelReplica{fetch: fetch, push: push}
 
-	paramMsg := messenger.Connect(parameterAddress)
+	params, err := ConnectParameterShards(parameterAddresses, backupAddresses, scheme)
+	if err != nil {
+		log.Println("ERR:", err)
+		return
+	}
+	defer params.Close()
 
-	paramMsg.SendMessage("MDL")
-	var networkConfig network.NetworkConfig
-	paramMsg.ReceiveInterface(&networkConfig)
-	mr.model = network.NewNetworkFromConfig(networkConfig)
+	mr.model = network.NewNetworkFromConfig(params.Config())
 	log.Println("Received model configuration")
 
-	var dataMsg messenger.Messenger
+	var dataMsg *messenger.Reconnecting
 
-	var data *network.Data
 	var dataBatches [][]network.Record
 	if dataAddress != "" {
-		dataMsg = messenger.Connect(dataAddress)
+		dataMsg, err = messenger.ConnectReconnecting([]string{dataAddress}, nil)
+		if err != nil {
+			log.Println("ERR:", err)
+			return
+		}
+		defer dataMsg.Close()
 	} else {
-		data = network.LoadData()
 		dataBatches = data.GetMiniBatches(lib.MiniBatchSize)
 	}
 
@@ -44,15 +51,24 @@ func LaunchModelReplica(dataAddress string, parameterAddress string, requestSize
 	weights, biases := mr.model.ZeroedParameters()
 
 	usedMiniBatches := 0
-	for {
+	for trainFor == 0 || time.Since(start) < trainFor {
 
 		// fmt.Println("Requesting mini-batches...")
 
 		var miniBatches [][]network.Record
 		if dataAddress != "" {
 			if usedMiniBatches+push >= len(miniBatches)-1 {
-				dataMsg.SendMessage("REQ " + strconv.Itoa(requestSize))
-				dataMsg.ReceiveInterface(&miniBatches)
+				err = dataMsg.Do(func(msg messenger.Messenger) error {
+					reply, err := msg.Request(messenger.DataRequest, requestSize)
+					if err != nil {
+						return err
+					}
+					return reply.Decode(&miniBatches)
+				})
+				if err != nil {
+					log.Println("ERR: lost connection to data server", err)
+					return
+				}
 
 				usedMiniBatches = 0
 			}
@@ -73,7 +89,11 @@ func LaunchModelReplica(dataAddress string, parameterAddress string, requestSize
 		for i := usedMiniBatches; i < stop; i++ {
 			// Only make a request after fetch minibatches
 			if request == 0 {
-				mr.receiveParameters(paramMsg)
+				err = params.Fetch(mr.model)
+				if err != nil {
+					log.Println("ERR: could not fetch parameters", err)
+					return
+				}
 				request = fetch
 			}
 			request--
@@ -87,29 +107,19 @@ func LaunchModelReplica(dataAddress string, parameterAddress string, requestSize
 
 			usedMiniBatches++
 		}
-		mr.sendDeltas(paramMsg, weights, biases)
+		err = params.Push(weights, biases)
+		if err != nil {
+			log.Println("ERR: could not push deltas", err)
+			return
+		}
 		weights, biases = mr.model.ZeroedParameters()
 		// fmt.Println("Finished training")
 	}
-}
-
-func (mr *ModelReplica) receiveParameters(msg messenger.Messenger) {
-	// Send request to parameter server
-	msg.SendMessage("REQ")
 
-	// Retrieve weights and biases for each layer from parameter server
-	var weights []mat.Dense
-	var biases []mat.VecDense
-
-	msg.ReceiveInterface(&weights)
-	msg.ReceiveInterface(&biases)
-
-	mr.model.SetParameters(weights, biases)
-}
-
-func (mr *ModelReplica) sendDeltas(msg messenger.Messenger, weights []mat.Dense, biases []mat.VecDense) {
-	// send weight and bias deltas to parameter server
-	msg.SendMessage("UPD")
-	msg.SendInterface(weights)
-	msg.SendInterface(biases)
+	err = params.Leave()
+	if err != nil {
+		log.Println("ERR: could not leave", err)
+		return
+	}
+	log.Println("Left after training for", time.Since(start))
 }
@@ -1,91 +1,446 @@
 package downpour
 
 import (
+	"comp3200/lib/compression"
+	"comp3200/lib/membership"
 	"comp3200/lib/messenger"
 	"comp3200/lib/network"
+	"errors"
+	"fmt"
 	"log"
-	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"gonum.org/v1/gonum/mat"
 )
 
-// ParameterServer is a struct that represents a Downpour parameter server
+// ParameterServer is a struct that represents a Downpour parameter server, or one shard of it
 type ParameterServer struct {
-	model *network.Network
+	model  *network.Network
+	shard  int
+	shards int
+
+	// layers holds what the server keeps for each layer of the model. An update passes through them in order, so that
+	// different updates change different layers at once. version counts applied updates and, like histogram, is guarded by
+	// the mutex of the first layer. backup receives every applied update so that it can be streamed to a backup server, it is
+	// only replaced while every layer is locked
+	layers    []*layer
+	version   uint64
+	histogram stalenessHistogram
+	backup    chan []float64
+
+	// policy decides how updates are applied given their staleness and optimiser turns them into steps of the parameters
+	policy    StalenessPolicy
+	optimiser Optimiser
+
+	// registry holds the replicas training with this server
+	registry *membership.Registry
 }
 
-var data *network.Data
+// layer is a struct that holds what a parameter server keeps for one layer of the model, whose parameters take length elements
+// from offset of the flattened parameters. An update takes the mutex of each layer before releasing that of the one before,
+// so that updates pass through the layers in the order they were given versions
+type layer struct {
+	mutex      sync.Mutex
+	offset     int
+	length     int
+	rows, cols int
 
-// LaunchParameterServer starts a parameter server with specified parameters
-func LaunchParameterServer(address string, model *network.Network, isAsync bool) {
+	// published holds the view of the layer that pulls are served from, replaced after every update so that pulls never wait for one
+	published atomic.Value
 
-	data = network.LoadData()
+	// velocity is the momentum policy's running update and accumulators Adagrad's sum of squared gradients of each parameter of the layer
+	velocity     []float64
+	accumulators []float64
+}
 
-	log.Println("Launching parameter server")
-	ps := ParameterServer{model}
+// view returns the view of the layer last published
+func (l *layer) view() layerView {
+	return l.published.Load().(layerView)
+}
 
-	l, err := net.Listen("tcp4", address)
-	if err != nil {
-		log.Println("ERR:", err)
-		return
+// overlap returns the part of the flattened parameters from start to end that belongs to the layer, empty if none does
+func (l *layer) overlap(start int, end int) (int, int) {
+	from, to := l.offset, l.offset+l.length
+	if from < start {
+		from = start
+	}
+	if to > end {
+		to = end
+	}
+	if to <= from {
+		return l.offset, l.offset
 	}
+	return from, to
+}
 
-	for {
-		conn, err := l.Accept()
+// BackupRetryInterval is how long a primary waits before connecting to its backup again
+var BackupRetryInterval = time.Second
+
+// LaunchParameterServer starts a parameter server with specified parameters
+func LaunchParameterServer(address string, model *network.Network) {
+	LaunchParameterShard(address, model, 0, 1, "", NoStalenessPolicy, SGDOptimiser, "")
+}
+
+// LaunchParameterShard starts a parameter server that owns one of shards equal sections of the model parameters,
+// streaming every applied update to the server at backupAddress if one is given. Stale updates are treated according to policy
+// and then applied with optimiser. If checkpointPath is given the server restarts from the checkpoint there and saves a new one regularly
+func LaunchParameterShard(address string, model *network.Network, shard int, shards int, backupAddress string, policy StalenessPolicy, optimiser Optimiser, checkpointPath string) {
+	log.Println("Launching parameter server shard", shard, "of", shards, "with staleness policy", policy, "and optimiser", optimiser)
+	ps := newParameterServer(model, shard, shards, policy, optimiser)
+	if checkpointPath != "" {
+		restored, err := ps.restoreCheckpoint(checkpointPath)
 		if err != nil {
 			log.Println("ERR:", err)
 			return
 		}
-		go ps.handleConnection(messenger.NewMessenger(conn))
+		if restored {
+			log.Println("Restored parameters from checkpoint", checkpointPath)
+		}
+		go ps.saveCheckpoints(checkpointPath)
+	}
+	go ps.logStaleness()
+
+	l, err := messenger.Listen(address)
+	if err != nil {
+		log.Println("ERR:", err)
+		return
+	}
+
+	if backupAddress != "" {
+		go ps.replicateTo(backupAddress)
+	}
+
+	err = messenger.Serve(l, ps.handleConnection)
+	log.Println("ERR:", err)
+}
+
+// newParameterServer creates a parameter server for one of shards sections of model, publishing its parameters as version 0
+func newParameterServer(model *network.Network, shard int, shards int, policy StalenessPolicy, optimiser Optimiser) *ParameterServer {
+	ps := &ParameterServer{model: model, shard: shard, shards: shards, policy: policy, optimiser: optimiser, registry: membership.NewRegistry()}
+	offset := 0
+	for j := 0; j < model.Layers(); j++ {
+		weights, biases := model.LayerParameters(j)
+		l := &layer{offset: offset}
+		l.rows, l.cols = weights.Dims()
+		l.length = l.rows*l.cols + biases.Len()
+		l.published.Store(layerView{0, make([]uint64, l.length), flatten(weights, biases)})
+		ps.layers = append(ps.layers, l)
+		offset += l.length
+	}
+	return ps
+}
+
+// flatten returns the parameters of a single layer as a slice
+func flatten(weights mat.Dense, biases mat.VecDense) []float64 {
+	return network.FlattenParameters([]mat.Dense{weights}, []mat.VecDense{biases})
+}
+
+// lockLayers takes the mutex of every layer in order, so that no update is applied until unlockLayers is called
+func (ps *ParameterServer) lockLayers() {
+	for _, l := range ps.layers {
+		l.mutex.Lock()
 	}
 }
 
+func (ps *ParameterServer) unlockLayers() {
+	for _, l := range ps.layers {
+		l.mutex.Unlock()
+	}
+}
+
+// length returns the number of flattened parameters of the model
+func (ps *ParameterServer) length() int {
+	last := ps.layers[len(ps.layers)-1]
+	return last.offset + last.length
+}
+
 func (ps *ParameterServer) handleConnection(msg messenger.Messenger) {
 	log.Println("New model replica connected")
+	defer msg.Close()
+	// The compression scheme this client's updates use, agreed in its model request, and its membership once it has joined
+	scheme := compression.None
+	var member membership.Member
+	defer func() {
+		ps.registry.Deregister(member.ID)
+	}()
+	// Receive skips heartbeats, so they are recorded here to keep an idle member's LastSeen current
+	msg.OnHeartbeat(func() {
+		ps.registry.Seen(member.ID)
+	})
 	for {
-		var cmd string
-		msg.ReceiveMessage(&cmd)
-
-		switch cmd {
-		// Requesting parameters
-		case "REQ":
-			ps.handleParameterRequest(msg)
-			break
-		case "UPD":
-			ps.handleParameterUpdate(msg)
-			break
-		case "MDL":
-			ps.handleModelRequest(msg)
-			break
+		env, err := msg.Receive()
+
+		if err == nil {
+			ps.registry.Seen(member.ID)
+			switch env.Kind {
+			// Requesting parameters
+			case messenger.ParameterRequest:
+				err = ps.handleParameterRequest(msg, env)
+				break
+			case messenger.ParameterUpdate:
+				err = ps.handleParameterUpdate(env, scheme)
+				break
+			case messenger.ModelRequest:
+				scheme, err = ps.handleModelRequest(msg, env)
+				break
+			// Sent by a primary server to its backup
+			case messenger.Snapshot:
+				err = ps.handleSnapshot(env)
+				break
+			case messenger.ReplicatedUpdate:
+				err = ps.handleReplicatedUpdate(env)
+				break
+			case messenger.Join:
+				member, err = ps.registry.HandleJoin(msg, env, member)
+				break
+			case messenger.Leave:
+				err = ps.registry.HandleLeave(msg, env, member.ID)
+				member = membership.Member{}
+				break
+			case messenger.MemberRequest:
+				err = ps.registry.HandleMemberRequest(msg, env)
+				break
+			default:
+				err = messenger.Unexpected(env)
+			}
+		}
+
+		if errors.Is(err, messenger.ErrPeerClosed) {
+			log.Println("Model replica disconnected")
+			return
+		} else if errors.Is(err, messenger.ErrTimeout) {
+			log.Println("Model replica timed out, assuming it is dead")
+			return
+		} else if err != nil {
+			log.Println("ERR:", err)
+			return
 		}
 	}
 }
 
-func (ps *ParameterServer) handleParameterRequest(msg messenger.Messenger) {
+func (ps *ParameterServer) handleParameterRequest(msg messenger.Messenger, request messenger.Envelope) error {
 	//fmt.Println("Received request for parameters")
-	weights, biases := ps.model.Parameters()
 
-	// send current state of weights and biases
-	msg.SendInterface(weights)
-	msg.SendInterface(biases)
+	// The request carries the version the replica last pulled, or 0 if it needs everything
+	var since uint64
+	err := request.Decode(&since)
+	if err != nil {
+		return err
+	}
+
+	// Reading the last layer first means no view is older than the version replied with
+	views := make([]layerView, len(ps.layers))
+	for j := len(ps.layers) - 1; j >= 0; j-- {
+		views[j] = ps.layers[j].view()
+	}
+
+	// A shard only sends its own section of the parameters
+	start, end := ShardRange(ps.shard, ps.shards, ps.length())
+	diff, values := ps.diff(views, start, end, since)
+
+	return msg.Reply(request, diff, values)
+}
+
+func (ps *ParameterServer) handleModelRequest(msg messenger.Messenger, request messenger.Envelope) (compression.Scheme, error) {
+	scheme := compression.Negotiate(request)
+	log.Println("Model replica compresses updates with", scheme)
+	return scheme, msg.Reply(request, ps.model.Config, scheme.String())
+}
+
+func (ps *ParameterServer) handleParameterUpdate(update messenger.Envelope, scheme compression.Scheme) error {
+
+	// receive the version the deltas were computed on and the deltas for this server's section of the flattened parameters
+	var version uint64
+	var section []float64
+	start, end := ShardRange(ps.shard, ps.shards, ps.length())
+
+	if ps.shards > 1 {
+		var err error
+		version, section, err = compression.ReceiveSection(update, scheme, end-start)
+		if err != nil {
+			return err
+		}
+		if len(section) != end-start {
+			return fmt.Errorf("section has %d elements, shard %d has %d", len(section), ps.shard, end-start)
+		}
+	} else {
+		var err error
+		var weightDeltas []mat.Dense
+		var biasDeltas []mat.VecDense
+		version, weightDeltas, biasDeltas, err = compression.ReceiveDeltas(update, scheme, ps.model)
+		if err != nil {
+			return err
+		}
+		section = network.FlattenParameters(weightDeltas, biasDeltas)
+	}
+
+	ps.update(version, start, section, false)
+	return nil
+}
+
+// update applies deltas to the parameters from start of the flattened parameters. An update from a replica, computed on version,
+// is first treated as the staleness policy says, one replicated from a primary already has been. Either is then applied with the
+// optimiser. The deltas the optimiser is given are passed on to the backup in the order they were applied, so that the backup's
+// optimiser keeps the same state.
+// The update passes through the layers in order, holding the mutex of one layer at a time apart from when moving to the next
+func (ps *ParameterServer) update(version uint64, start int, section []float64, replicated bool) {
+	first := ps.layers[0]
+	first.mutex.Lock()
+	staleness := ps.staleness(version)
+	if !replicated {
+		dropped := ps.policy.Name == DropStale && staleness > ps.policy.MaxStaleness
+		ps.histogram.record(staleness, dropped)
+		if dropped {
+			first.mutex.Unlock()
+			return
+		}
+	}
+	ps.version++
+	current := ps.version
+
+	// The backup is only replaced while every layer is locked, so it cannot change while this update holds one
+	var applied []float64
+	if ps.backup != nil {
+		applied = make([]float64, len(section))
+	}
+
+	for j, l := range ps.layers {
+		if j > 0 {
+			l.mutex.Lock()
+			ps.layers[j-1].mutex.Unlock()
+		}
+
+		from, to := l.overlap(start, start+len(section))
+		if from == to {
+			// Nothing of this layer belongs to the section, but the update must still pass through it
+			view := l.view()
+			view.version = current
+			l.published.Store(view)
+			continue
+		}
+
+		deltas := make([]float64, l.length)
+		copy(deltas[from-l.offset:], section[from-start:to-start])
+		if !replicated {
+			ps.adjust(l, deltas, staleness)
+		}
+		if applied != nil {
+			copy(applied[from-start:to-start], deltas[from-l.offset:])
+		}
+		ps.optimise(l, deltas)
+		ps.updateLayer(j, current, deltas)
+	}
+
+	if applied != nil {
+		ps.backup <- applied
+	}
+	ps.layers[len(ps.layers)-1].mutex.Unlock()
 }
 
-func (ps *ParameterServer) handleModelRequest(msg messenger.Messenger) {
-	msg.SendInterface(ps.model.Config)
+// updateLayer applies deltas to layer j of the model and publishes the result as of version, the mutex of the layer must be held
+func (ps *ParameterServer) updateLayer(j int, version uint64, deltas []float64) {
+	l := ps.layers[j]
+	size := l.rows * l.cols
+	ps.model.UpdateLayerWithDeltas(j, mat.NewDense(l.rows, l.cols, deltas[:size]), mat.NewVecDense(l.length-size, deltas[size:]))
+
+	weights, biases := ps.model.LayerParameters(j)
+	l.published.Store(l.view().changed(version, deltas, flatten(weights, biases)))
+}
+
+// replicateTo keeps the backup server at address up to date for as long as the server runs. It connects in the background and
+// reconnects whenever the connection is lost, so a backup that is unreachable never holds up replicas
+func (ps *ParameterServer) replicateTo(address string) {
+	for {
+		msg, err := messenger.Connect(address)
+		if err != nil {
+			log.Println("ERR: could not connect to backup parameter server", err)
+		} else {
+			err = ps.stream(msg)
+
+			// Losing the backup must not take down the primary, so stop replicating until it is reachable again
+			log.Println("ERR: lost connection to backup parameter server", err)
+		}
+		time.Sleep(BackupRetryInterval)
+	}
 }
 
-var updates int
+// stream sends a snapshot of the model to a backup server and then every subsequent update, until the connection fails
+func (ps *ParameterServer) stream(msg messenger.Messenger) error {
+	defer msg.Close()
+	log.Println("Replicating to backup parameter server")
 
-func (ps *ParameterServer) handleParameterUpdate(msg messenger.Messenger) {
+	// Holding every lock ensures no update is both in the snapshot and in the stream
+	ps.lockLayers()
+	weights, biases := ps.model.Parameters()
+	optimiser, accumulators := ps.optimiser, ps.accumulators()
+	backup := make(chan []float64, 100)
+	ps.backup = backup
+	ps.unlockLayers()
 
-	// receive deltas for weights and biases
-	var weightDeltas []mat.Dense
-	var biasDeltas []mat.VecDense
+	// The stream may be idle for a long time, so keep the backup from timing out the connection
+	stopHeartbeat := msg.StartHeartbeat()
+	defer stopHeartbeat()
 
-	msg.ReceiveInterface(&weightDeltas)
-	msg.ReceiveInterface(&biasDeltas)
+	err := msg.Send(messenger.Snapshot, weights, biases, optimiser, accumulators)
+	for err == nil {
+		err = msg.Send(messenger.ReplicatedUpdate, <-backup)
+	}
 
-	// update master model with deltas
-	ps.model.UpdateWithDeltas(weightDeltas, biasDeltas)
-	updates++
+	// Drain the channel so that an update blocked on it can release its lock, until no update can send to it any more
+	go func() {
+		for range backup {
+		}
+	}()
+	ps.lockLayers()
+	ps.backup = nil
+	ps.unlockLayers()
+	close(backup)
+	return err
+}
+
+// handleSnapshot replaces the parameters with those of the primary, which the backup then optimises as the primary does,
+// starting from the primary's accumulators
+func (ps *ParameterServer) handleSnapshot(snapshot messenger.Envelope) error {
+	var weights []mat.Dense
+	var biases []mat.VecDense
+	var optimiser Optimiser
+	var accumulators []float64
+
+	err := snapshot.Decode(&weights, &biases, &optimiser, &accumulators)
+	if err != nil {
+		return err
+	}
+	if accumulators != nil && len(accumulators) != ps.length() {
+		return fmt.Errorf("snapshot has %d accumulators for %d parameters", len(accumulators), ps.length())
+	}
+
+	ps.lockLayers()
+	ps.model.SetParameters(weights, biases)
+	ps.version++
+	for j, l := range ps.layers {
+		w, b := ps.model.LayerParameters(j)
+		l.published.Store(l.view().replaced(ps.version, flatten(w, b)))
+	}
+	ps.optimiser = optimiser
+	ps.setAccumulators(accumulators)
+	ps.unlockLayers()
+	log.Println("Received snapshot from primary parameter server, optimising with", optimiser)
+	return nil
+}
+
+func (ps *ParameterServer) handleReplicatedUpdate(update messenger.Envelope) error {
+	var section []float64
+	err := update.Decode(&section)
+	if err != nil {
+		return err
+	}
+
+	start, end := ShardRange(ps.shard, ps.shards, ps.length())
+	if len(section) != end-start {
+		return fmt.Errorf("replicated update has %d elements, shard %d has %d", len(section), ps.shard, end-start)
+	}
+	ps.update(0, start, section, true)
+	return nil
 }
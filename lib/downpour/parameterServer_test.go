@@ -0,0 +1,399 @@
+package downpour
+
+import (
+	"comp3200/lib/compression"
+	"comp3200/lib/messenger"
+	"comp3200/lib/network"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// servers counts the parameter servers started, as a server keeps its address until the process exits
+var servers int
+
+// BenchmarkParameterServer measures how many pulls and pushes a parameter server completes each second as replicas are added.
+// Every push changes every parameter, so every pull is of the whole model
+func BenchmarkParameterServer(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, replicas := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("replicas=%d", replicas), func(b *testing.B) {
+			benchmarkParameterServer(b, replicas)
+		})
+	}
+}
+
+func benchmarkParameterServer(b *testing.B, replicas int) {
+	servers++
+	address := fmt.Sprintf("%sbenchmark%d", messenger.MemoryScheme, servers)
+	model := network.NewNetwork().WithLayer(784, 300, "sigmoid").WithLayer(300, 100, "sigmoid").WithLayer(100, 10, "softmax")
+	go LaunchParameterShard(address, model, 0, 1, "", NoStalenessPolicy, SGDOptimiser, "")
+
+	var shards []*ParameterShards
+	for i := 0; i < replicas; i++ {
+		ps, err := ConnectParameterShards([]string{address}, nil, compression.None)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer ps.Close()
+		shards = append(shards, ps)
+	}
+
+	weights, biases := model.ZeroedParameters()
+	flat := network.FlattenParameters(weights, biases)
+	for i := range flat {
+		flat[i] = 1e-6
+	}
+	network.UnflattenParameters(flat, weights, biases)
+
+	// Each replica pulls and then pushes, so a round completes once the server has applied the push before it
+	b.ResetTimer()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i, ps := range shards {
+		rounds := b.N / replicas
+		if i < b.N%replicas {
+			rounds++
+		}
+
+		wg.Add(1)
+		go func(ps *ParameterShards, rounds int) {
+			defer wg.Done()
+			replica := network.NewNetworkFromConfig(ps.Config())
+			for r := 0; r < rounds; r++ {
+				err := ps.Fetch(replica)
+				if err == nil {
+					err = ps.Push(weights, biases)
+				}
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(ps, rounds)
+	}
+	wg.Wait()
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "rounds/s")
+}
+
+// TestSilentPeer checks that a peer that connects and never says hello does not stop other replicas connecting
+func TestSilentPeer(t *testing.T) {
+	checkSilentPeer(t)
+}
+
+// TestUnauthenticatedPeer checks that a peer that connects and never answers the authentication challenge does not
+// stop replicas that know the shared secret connecting
+func TestUnauthenticatedPeer(t *testing.T) {
+	messenger.SetSecret([]byte("secret"))
+	defer messenger.SetSecret(nil)
+	checkSilentPeer(t)
+}
+
+// checkSilentPeer starts a parameter server, connects to it without saying anything and checks that a replica can still connect
+func checkSilentPeer(t *testing.T) {
+	servers++
+	name := fmt.Sprintf("silent%d", servers)
+	model := network.NewNetwork().WithLayer(4, 3, "sigmoid").WithLayer(3, 2, "softmax")
+	go LaunchParameterServer(messenger.MemoryScheme+name, model)
+
+	// The in-memory transport refuses connections until the server is listening
+	var silent net.Conn
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		silent, err = messenger.Memory.Dial(name)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	connected := make(chan error, 1)
+	go func() {
+		ps, err := ConnectParameterShards([]string{messenger.MemoryScheme + name}, nil, compression.None)
+		if err == nil {
+			ps.Close()
+		}
+		connected <- err
+	}()
+
+	select {
+	case err := <-connected:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("replica could not connect while another peer was silent")
+	}
+}
+
+// TestConcurrentUpdates checks that updates passing through the layers at once are all applied, and that a pull sees what they changed
+func TestConcurrentUpdates(t *testing.T) {
+	model := network.NewNetwork().WithLayer(4, 6, "sigmoid").WithLayer(6, 5, "sigmoid").WithLayer(5, 2, "softmax").WithLearningRate(0.5)
+	weights, biases := model.Parameters()
+	before := network.FlattenParameters(weights, biases)
+	ps := newParameterServer(model, 0, 1, NoStalenessPolicy, SGDOptimiser)
+
+	// Every update moves a different parameter, along with the first
+	updates := len(before) - 1
+	var wg sync.WaitGroup
+	for u := 1; u <= updates; u++ {
+		wg.Add(1)
+		go func(u int) {
+			defer wg.Done()
+			deltas := make([]float64, len(before))
+			deltas[0], deltas[u] = 1, 1
+			ps.update(0, 0, deltas, false)
+		}(u)
+	}
+	wg.Wait()
+
+	weights, biases = model.Parameters()
+	after := network.FlattenParameters(weights, biases)
+	for i := range before {
+		moved := 0.5
+		if i == 0 {
+			moved *= float64(updates)
+		}
+		if math.Abs(before[i]-after[i]-moved) > 1e-9 {
+			t.Fatalf("parameter %d moved %f, expected %f", i, before[i]-after[i], moved)
+		}
+	}
+
+	views := make([]layerView, len(ps.layers))
+	for j, l := range ps.layers {
+		views[j] = l.view()
+	}
+	diff, values := ps.diff(views, 0, len(after), 0)
+	if !diff.Full || diff.Version != uint64(updates) {
+		t.Fatalf("pull of everything replied with %+v, expected the whole model at version %d", diff, updates)
+	}
+	for i := range after {
+		if values[i] != after[i] {
+			t.Fatalf("pull of parameter %d is %f, the model has %f", i, values[i], after[i])
+		}
+	}
+
+	// Only what the last update changed has changed since the one before it
+	deltas := make([]float64, len(before))
+	deltas[len(deltas)-1] = 1
+	ps.update(0, 0, deltas, false)
+	for j, l := range ps.layers {
+		views[j] = l.view()
+	}
+	diff, values = ps.diff(views, 0, len(after), uint64(updates))
+	if diff.Full || len(diff.Indices) != 1 || int(diff.Indices[0]) != len(after)-1 || values[0] != after[len(after)-1]-0.5 {
+		t.Fatalf("pull since version %d replied with %+v %v, expected only the last parameter", updates, diff, values)
+	}
+}
+
+// BenchmarkUpdate measures how many updates a parameter server applies each second as updates are pushed concurrently,
+// against the same updates applied under one lock over the whole model as they were before layers were locked separately
+func BenchmarkUpdate(b *testing.B) {
+	model := network.NewNetwork().WithLayer(784, 300, "sigmoid").WithLayer(300, 100, "sigmoid").WithLayer(100, 10, "softmax")
+	weights, biases := model.ZeroedParameters()
+	deltas := network.FlattenParameters(weights, biases)
+	for i := range deltas {
+		deltas[i] = 1e-6
+	}
+	network.UnflattenParameters(deltas, weights, biases)
+
+	b.Run("baseline", func(b *testing.B) {
+		// The whole model is updated, versioned and flattened for pulls under one lock
+		var mutex sync.Mutex
+		modified := make([]uint64, len(deltas))
+		var version uint64
+		var published atomic.Value
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				mutex.Lock()
+				model.UpdateWithDeltas(weights, biases)
+				version++
+				modified = append([]uint64(nil), modified...)
+				for i, d := range deltas {
+					if d != 0 {
+						modified[i] = version
+					}
+				}
+				w, b := model.Parameters()
+				published.Store(network.FlattenParameters(w, b))
+				mutex.Unlock()
+			}
+		})
+	})
+
+	b.Run("layered", func(b *testing.B) {
+		ps := newParameterServer(model, 0, 1, NoStalenessPolicy, SGDOptimiser)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				ps.update(0, 0, deltas, false)
+			}
+		})
+	})
+}
+
+// serve starts ps serving on an in-memory address and returns the address and a function that kills the server, closing
+// its listener and every connection to it as if its process had died
+func serve(t *testing.T, ps *ParameterServer, role string) (string, func()) {
+	servers++
+	address := fmt.Sprintf("%s%s%d", messenger.MemoryScheme, role, servers)
+	l, err := messenger.Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mutex sync.Mutex
+	var conns []messenger.Messenger
+	go messenger.Serve(l, func(msg messenger.Messenger) {
+		mutex.Lock()
+		conns = append(conns, msg)
+		mutex.Unlock()
+		ps.handleConnection(msg)
+	})
+	return address, func() {
+		l.Close()
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, msg := range conns {
+			msg.Close()
+		}
+	}
+}
+
+// parameters returns the parameters of a server's model as one vector
+func (ps *ParameterServer) parameters() []float64 {
+	ps.lockLayers()
+	defer ps.unlockLayers()
+	weights, biases := ps.model.Parameters()
+	return network.FlattenParameters(weights, biases)
+}
+
+// converges polls until ps has the parameters expected returns, returning false if it does not within five seconds
+func converges(ps *ParameterServer, expected func() []float64) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		got, want := ps.parameters(), expected()
+		same := true
+		for i := range got {
+			if math.Abs(got[i]-want[i]) > 1e-12 {
+				same = false
+				break
+			}
+		}
+		if same {
+			return true
+		}
+	}
+	return false
+}
+
+// TestFailover checks that a replica carries on training with the backup once its primary dies, from where the primary left off
+func TestFailover(t *testing.T) {
+	defer func(timeout time.Duration) { messenger.ReconnectTimeout = timeout }(messenger.ReconnectTimeout)
+	messenger.ReconnectTimeout = 100 * time.Millisecond
+
+	model := network.NewNetwork().WithLayer(4, 3, "sigmoid").WithLayer(3, 2, "softmax").WithLearningRate(0.5)
+	backup := newParameterServer(network.NewNetworkFromConfig(model.Config), 0, 1, NoStalenessPolicy, SGDOptimiser)
+	backupAddress, stopBackup := serve(t, backup, "backup")
+	defer stopBackup()
+	primary := newParameterServer(model, 0, 1, NoStalenessPolicy, SGDOptimiser)
+	primaryAddress, kill := serve(t, primary, "primary")
+	go primary.replicateTo(backupAddress)
+
+	ps, err := ConnectParameterShards([]string{primaryAddress}, []string{backupAddress}, compression.None)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	replica := network.NewNetworkFromConfig(ps.Config())
+	weights, biases := replica.ZeroedParameters()
+	flat := network.FlattenParameters(weights, biases)
+	for i := range flat {
+		flat[i] = 0.01
+	}
+	network.UnflattenParameters(flat, weights, biases)
+
+	train := func() {
+		for i := 0; i < 2; i++ {
+			err := ps.Fetch(replica)
+			if err == nil {
+				err = ps.Push(weights, biases)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	train()
+	if !converges(backup, primary.parameters) {
+		t.Fatal("backup did not replicate the primary")
+	}
+
+	kill()
+	before := backup.parameters()
+	train()
+	err = ps.Fetch(replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := backup.parameters()
+	weights, biases = replica.Parameters()
+	fetched := network.FlattenParameters(weights, biases)
+	for i := range after {
+		if math.Abs(after[i]-before[i]) < 1e-9 {
+			t.Fatalf("backup parameter %d did not change after failing over", i)
+		}
+		if math.Abs(fetched[i]-after[i]) > 1e-12 {
+			t.Fatalf("replica fetched parameter %d as %f, backup has %f", i, fetched[i], after[i])
+		}
+	}
+}
+
+// TestUnreachableBackup checks that a primary whose backup is not listening serves replicas straight away and starts
+// replicating once the backup is
+func TestUnreachableBackup(t *testing.T) {
+	defer func(interval time.Duration) { BackupRetryInterval = interval }(BackupRetryInterval)
+	BackupRetryInterval = 10 * time.Millisecond
+	servers++
+	backupAddress := fmt.Sprintf("%slatebackup%d", messenger.MemoryScheme, servers)
+	servers++
+	primaryAddress := fmt.Sprintf("%searlyprimary%d", messenger.MemoryScheme, servers)
+	model := network.NewNetwork().WithLayer(4, 3, "sigmoid").WithLayer(3, 2, "softmax")
+	go LaunchParameterShard(primaryAddress, model, 0, 1, backupAddress, NoStalenessPolicy, SGDOptimiser, "")
+
+	start := time.Now()
+	ps, err := ConnectParameterShards([]string{primaryAddress}, nil, compression.None)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	if time.Since(start) > messenger.ConnectTimeout/2 {
+		t.Errorf("replica took %v to connect to a primary whose backup is unreachable", time.Since(start))
+	}
+
+	backup := newParameterServer(network.NewNetworkFromConfig(model.Config), 0, 1, NoStalenessPolicy, SGDOptimiser)
+	l, err := messenger.Listen(backupAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go messenger.Serve(l, backup.handleConnection)
+
+	expected := func() []float64 {
+		return network.FlattenParameters(model.Parameters())
+	}
+	if !converges(backup, expected) {
+		t.Fatal("backup that started late was never sent a snapshot")
+	}
+}
@@ -0,0 +1,213 @@
+package downpour
+
+import (
+	"comp3200/lib/compression"
+	"comp3200/lib/membership"
+	"comp3200/lib/messenger"
+	"comp3200/lib/network"
+	"fmt"
+	"log"
+	"sync"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// ParameterShards is a struct that represents connections to every shard of a parameter server
+type ParameterShards struct {
+	shards []*messenger.Reconnecting
+	config network.NetworkConfig
+
+	// Each shard has its own compressor, as error feedback is kept per section of the parameters
+	scheme      compression.Scheme
+	compressors []*compression.Compressor
+
+	// cache holds the flattened parameters as of the version last pulled from each shard, so that only changes need pulling
+	cache    []float64
+	versions []uint64
+}
+
+// ShardRange returns the bounds of the section of a flattened parameter vector of a given length that a shard owns
+func ShardRange(shard int, shards int, length int) (int, int) {
+	return shard * length / shards, (shard + 1) * length / shards
+}
+
+// ConnectParameterShards connects to every parameter server shard, addresses must be ordered by shard.
+// backups optionally lists the backup server of each shard to fail over to, or "" if a shard has none,
+// and pushes are compressed with scheme wherever the shard agrees to it
+func ConnectParameterShards(addresses []string, backups []string, scheme compression.Scheme) (*ParameterShards, error) {
+	ps := ParameterShards{scheme: scheme, compressors: make([]*compression.Compressor, len(addresses)), versions: make([]uint64, len(addresses))}
+	for i, address := range addresses {
+		shardAddresses := []string{address}
+		if i < len(backups) && backups[i] != "" {
+			shardAddresses = append(shardAddresses, backups[i])
+		}
+
+		// Every connection, and every reconnection, starts by requesting the model configuration
+		shard := i
+		msg, err := messenger.ConnectReconnecting(shardAddresses, func(msg messenger.Messenger) error {
+			return ps.handshake(shard, msg)
+		})
+		if err != nil {
+			ps.Close()
+			return nil, fmt.Errorf("parameter shard %d: %w", i, err)
+		}
+		ps.shards = append(ps.shards, msg)
+	}
+	return &ps, nil
+}
+
+func (ps *ParameterShards) handshake(shard int, msg messenger.Messenger) error {
+	config, agreed, err := compression.RequestModel(msg, ps.scheme)
+	if err != nil {
+		return err
+	}
+
+	// A server forgets a member whose connection is lost, so every connection joins again
+	_, err = membership.Join(msg, membership.DefaultName())
+	if err != nil {
+		return err
+	}
+
+	// Versions are only meaningful to the server that issued them, so start again with a full pull
+	ps.versions[shard] = 0
+
+	// A backup may agree to a different scheme, in which case the error feedback so far is lost
+	compressor := ps.compressors[shard]
+	if compressor == nil || compressor.Scheme() != agreed {
+		if agreed != ps.scheme {
+			log.Println("Parameter shard", shard, "only accepts", agreed, "compression")
+		}
+		ps.compressors[shard] = compression.NewCompressor(agreed)
+	}
+
+	// Only the first connection records the configuration, later reconnections may run concurrently
+	if len(ps.shards) == 0 {
+		ps.config = config
+	}
+	return nil
+}
+
+// Leave deregisters from every shard, which then stops counting this replica as a member
+func (ps *ParameterShards) Leave() error {
+	for i := range ps.shards {
+		err := ps.call(i, membership.Leave)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the connection to every shard
+func (ps *ParameterShards) Close() {
+	for i := range ps.shards {
+		ps.shards[i].Close()
+	}
+}
+
+// call runs f with the connection to a shard, reconnecting or failing over to the shard's backup if the connection is lost.
+// f is run again in full after reconnecting, so an update may be applied twice if the connection failed after it was received
+func (ps *ParameterShards) call(shard int, f func(msg messenger.Messenger) error) error {
+	err := ps.shards[shard].Do(f)
+	if err != nil {
+		return fmt.Errorf("parameter shard %d: %w", shard, err)
+	}
+	return nil
+}
+
+// Config returns the model configuration, which every shard shares
+func (ps *ParameterShards) Config() network.NetworkConfig {
+	return ps.config
+}
+
+// Fetch retrieves the parameters held by every shard and sets them on a model, pulling only what changed since the last fetch
+func (ps *ParameterShards) Fetch(model *network.Network) error {
+	weights, biases := model.ZeroedParameters()
+	if ps.cache == nil {
+		ps.cache = network.FlattenParameters(weights, biases)
+	}
+
+	// Request every shard in parallel, each writes to its own section of the cache
+	errs := make([]error, len(ps.shards))
+	var wg sync.WaitGroup
+	for i := range ps.shards {
+		wg.Add(1)
+		go func(i int) {
+			errs[i] = ps.call(i, func(msg messenger.Messenger) error {
+				reply, err := msg.Request(messenger.ParameterRequest, ps.versions[i])
+				if err != nil {
+					return err
+				}
+
+				var diff ParameterDiff
+				var values []float64
+				err = reply.Decode(&diff, &values)
+				if err != nil {
+					return err
+				}
+
+				start, end := ShardRange(i, len(ps.shards), len(ps.cache))
+				if !diff.valid(len(values), end-start) {
+					return fmt.Errorf("malformed parameter diff with %d indices and %d values for a section of %d", len(diff.Indices), len(values), end-start)
+				}
+				if diff.Full {
+					copy(ps.cache[start:end], values)
+				} else {
+					for j, index := range diff.Indices {
+						ps.cache[start+int(index)] = values[j]
+					}
+				}
+				ps.versions[i] = diff.Version
+				return nil
+			})
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+
+	err := firstError(errs)
+	if err != nil {
+		return err
+	}
+
+	network.UnflattenParameters(ps.cache, weights, biases)
+	model.SetParameters(weights, biases)
+	return nil
+}
+
+// Push sends weight and bias deltas to the shards that own them, tagged with the version of each shard last fetched
+func (ps *ParameterShards) Push(weights []mat.Dense, biases []mat.VecDense) error {
+	if len(ps.shards) == 1 {
+		// send weight and bias deltas to parameter server
+		return ps.call(0, func(msg messenger.Messenger) error {
+			return compression.SendDeltas(msg, ps.compressors[0], ps.versions[0], weights, biases)
+		})
+	}
+
+	flat := network.FlattenParameters(weights, biases)
+
+	errs := make([]error, len(ps.shards))
+	var wg sync.WaitGroup
+	for i := range ps.shards {
+		wg.Add(1)
+		go func(i int) {
+			start, end := ShardRange(i, len(ps.shards), len(flat))
+			errs[i] = ps.call(i, func(msg messenger.Messenger) error {
+				return compression.SendSection(msg, ps.compressors[i], ps.versions[i], flat[start:end])
+			})
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+
+	return firstError(errs)
+}
+
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
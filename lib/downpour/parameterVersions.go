@@ -0,0 +1,103 @@
+package downpour
+
+// ParameterDiff is a struct that represents the header of a reply to a request for the parameters changed since a version.
+// It is followed by the values of the parameters at Indices, relative to the start of the shard's section,
+// or by the whole section if Full is set
+type ParameterDiff struct {
+	Version uint64
+	Full    bool
+	Indices []int32
+}
+
+// valid returns whether a diff followed by values can be applied to a section of a given length
+func (d ParameterDiff) valid(values int, length int) bool {
+	if d.Full {
+		return values == length
+	}
+	if values != len(d.Indices) {
+		return false
+	}
+	for _, index := range d.Indices {
+		if index < 0 || int(index) >= length {
+			return false
+		}
+	}
+	return true
+}
+
+// layerView is a struct that holds the flattened parameters of one layer as pulls see them, along with the version at which
+// each last changed. version is that of the last update to pass through the layer. A published view is never changed
+type layerView struct {
+	version  uint64
+	modified []uint64
+	flat     []float64
+}
+
+// changed returns a view of the layer after an update at version changed it to flat, marking the parameters the deltas moved
+func (v layerView) changed(version uint64, deltas []float64, flat []float64) layerView {
+	modified := append([]uint64(nil), v.modified...)
+	for i, d := range deltas {
+		if d != 0 {
+			modified[i] = version
+		}
+	}
+	return layerView{version, modified, flat}
+}
+
+// replaced returns a view of the layer after it was replaced by flat at version, as when the parameters are replaced by a snapshot
+func (v layerView) replaced(version uint64, flat []float64) layerView {
+	modified := make([]uint64, len(flat))
+	for i := range modified {
+		modified[i] = version
+	}
+	return layerView{version, modified, flat}
+}
+
+// diff returns the changes to the flattened parameters from start to end since a version, given a view of every layer.
+// Updates pass through the layers in order, so every change up to the version of the last layer is in every view, and that is
+// the version replied with. It falls back to the whole section when the requester has no version from us or when so much has
+// changed that sending indices would cost more than the section
+func (ps *ParameterServer) diff(views []layerView, start int, end int, since uint64) (ParameterDiff, []float64) {
+	version := views[0].version
+	for _, view := range views {
+		if view.version < version {
+			version = view.version
+		}
+	}
+
+	if since != 0 && since <= version {
+		diff, values, ok := ps.changedSince(views, start, end, since)
+		if ok {
+			diff.Version = version
+			return diff, values
+		}
+	}
+
+	section := make([]float64, 0, end-start)
+	for j, l := range ps.layers {
+		from, to := l.overlap(start, end)
+		section = append(section, views[j].flat[from-l.offset:to-l.offset]...)
+	}
+	return ParameterDiff{Version: version, Full: true}, section
+}
+
+// changedSince returns the indices and values of the parameters from start to end changed since a version,
+// or false if more than half of them were
+func (ps *ParameterServer) changedSince(views []layerView, start int, end int, since uint64) (ParameterDiff, []float64, bool) {
+	var diff ParameterDiff
+	var values []float64
+	for j, l := range ps.layers {
+		from, to := l.overlap(start, end)
+		for i := from; i < to; i++ {
+			if views[j].modified[i-l.offset] > since {
+				diff.Indices = append(diff.Indices, int32(i-start))
+				values = append(values, views[j].flat[i-l.offset])
+
+				if 2*len(values) > end-start {
+					return diff, nil, false
+				}
+			}
+		}
+	}
+	return diff, values, true
+}
@@ -0,0 +1,151 @@
+package downpour
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Staleness policies
+const (
+	IgnoreStaleness = "none"
+	DropStale       = "drop"
+	ScaleStale      = "scale"
+	StaleMomentum   = "momentum"
+)
+
+// StalenessPolicy is a struct that represents how a parameter server treats an update computed on parameters that
+// other updates have changed since, the staleness of an update being the number of updates applied in between
+type StalenessPolicy struct {
+	Name string
+
+	// MaxStaleness is the staleness beyond which the drop policy discards an update
+	MaxStaleness uint64
+
+	// Momentum is the momentum the momentum policy applies to fresh updates
+	Momentum float64
+}
+
+// NoStalenessPolicy applies every update as it is
+var NoStalenessPolicy = StalenessPolicy{Name: IgnoreStaleness}
+
+// ParseStalenessPolicy parses a policy of the form "none", "drop:<max staleness>", "scale" or "momentum:<momentum>"
+func ParseStalenessPolicy(s string) (StalenessPolicy, error) {
+	parts := strings.SplitN(s, ":", 2)
+	policy := StalenessPolicy{Name: parts[0]}
+	switch parts[0] {
+	case IgnoreStaleness, ScaleStale:
+		if len(parts) == 1 {
+			return policy, nil
+		}
+	case DropStale:
+		if len(parts) == 2 {
+			max, err := strconv.ParseUint(parts[1], 10, 64)
+			if err == nil {
+				policy.MaxStaleness = max
+				return policy, nil
+			}
+		}
+	case StaleMomentum:
+		if len(parts) == 2 {
+			momentum, err := strconv.ParseFloat(parts[1], 64)
+			if err == nil && momentum >= 0 && momentum < 1 {
+				policy.Momentum = momentum
+				return policy, nil
+			}
+		}
+	}
+	return StalenessPolicy{}, fmt.Errorf("unknown staleness policy %q, expected none, drop:<max staleness>, scale or momentum:<momentum in [0, 1)>", s)
+}
+
+func (p StalenessPolicy) String() string {
+	switch p.Name {
+	case DropStale:
+		return fmt.Sprintf("%s:%d", p.Name, p.MaxStaleness)
+	case StaleMomentum:
+		return p.Name + ":" + strconv.FormatFloat(p.Momentum, 'g', -1, 64)
+	}
+	return p.Name
+}
+
+// staleness returns how many updates were applied since the version an update was computed on.
+// An update that was not computed on a version from us, as after failing over to a backup, is treated as fresh.
+// The mutex of the first layer must be held
+func (ps *ParameterServer) staleness(version uint64) uint64 {
+	if version == 0 || version > ps.version {
+		return 0
+	}
+	return ps.version - version
+}
+
+// adjust applies the scale and momentum policies to the deltas of a layer, the drop policy is applied before an update
+// reaches any layer. The mutex of the layer must be held
+func (ps *ParameterServer) adjust(l *layer, deltas []float64, staleness uint64) {
+	switch ps.policy.Name {
+	case ScaleStale:
+		// Scaling the deltas is the same as scaling the learning rate
+		if staleness > 1 {
+			for i := range deltas {
+				deltas[i] /= float64(staleness)
+			}
+		}
+	case StaleMomentum:
+		// Asynchrony already adds momentum of roughly staleness/(staleness+1), so only the rest is applied explicitly
+		momentum := ps.policy.Momentum - float64(staleness)/float64(staleness+1)
+		if momentum < 0 {
+			momentum = 0
+		}
+
+		if l.velocity == nil {
+			l.velocity = make([]float64, len(deltas))
+		}
+		for i := range deltas {
+			l.velocity[i] = momentum*l.velocity[i] + deltas[i]
+		}
+		copy(deltas, l.velocity)
+	}
+}
+
+// maxBucket is the staleness from which updates share the last bucket of a histogram
+const maxBucket = 64
+
+// stalenessHistogram is a struct that counts the updates a parameter server received by their staleness
+type stalenessHistogram struct {
+	counts  [maxBucket + 1]int
+	dropped int
+}
+
+func (h *stalenessHistogram) record(staleness uint64, dropped bool) {
+	if staleness > maxBucket {
+		staleness = maxBucket
+	}
+	h.counts[staleness]++
+	if dropped {
+		h.dropped++
+	}
+}
+
+// logStaleness logs the staleness histogram of every update received so far once a minute, as "staleness,time,staleness,count" lines
+// for each staleness seen and a "staleness,time,dropped,count" line
+func (ps *ParameterServer) logStaleness() {
+	for minute := 0; ; minute++ {
+		ps.layers[0].mutex.Lock()
+		histogram := ps.histogram
+		ps.layers[0].mutex.Unlock()
+
+		for staleness, count := range histogram.counts {
+			if count == 0 {
+				continue
+			}
+			bucket := strconv.Itoa(staleness)
+			if staleness == maxBucket {
+				bucket += "+"
+			}
+			log.Printf("staleness,%d,%s,%d\n", minute, bucket, count)
+		}
+		log.Printf("staleness,%d,dropped,%d\n", minute, histogram.dropped)
+		time.Sleep(time.Minute)
+	}
+}
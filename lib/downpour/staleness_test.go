@@ -0,0 +1,91 @@
+package downpour
+
+import (
+	"comp3200/lib/network"
+	"math"
+	"testing"
+)
+
+// stalenessServer returns a parameter server with a learning rate of one and policy, and a function that applies an update
+// computed on version moving every parameter by delta, returning how far the first parameter moved
+func stalenessServer(policy StalenessPolicy) (*ParameterServer, func(version uint64, delta float64) float64) {
+	model := network.NewNetwork().WithLayer(3, 2, "sigmoid").WithLayer(2, 2, "softmax").WithLearningRate(1)
+	ps := newParameterServer(model, 0, 1, policy, SGDOptimiser)
+	return ps, func(version uint64, delta float64) float64 {
+		deltas := make([]float64, ps.length())
+		for i := range deltas {
+			deltas[i] = delta
+		}
+		before := ps.parameters()[0]
+		ps.update(version, 0, deltas, false)
+		return before - ps.parameters()[0]
+	}
+}
+
+func TestDropStale(t *testing.T) {
+	ps, update := stalenessServer(StalenessPolicy{Name: DropStale, MaxStaleness: 2})
+
+	// Updates that were not computed on a version from this server are fresh
+	for i := 0; i < 3; i++ {
+		update(0, 0)
+	}
+	if moved := update(1, 1); math.Abs(moved-1) > 1e-12 {
+		t.Errorf("update of the maximum staleness moved a parameter %f, expected 1", moved)
+	}
+	if moved := update(1, 1); moved != 0 || ps.version != 4 {
+		t.Errorf("update beyond the maximum staleness moved a parameter %f and left the server at version %d, expected 0 and 4", moved, ps.version)
+	}
+
+	expected := stalenessHistogram{dropped: 1}
+	expected.counts[0], expected.counts[2], expected.counts[3] = 3, 1, 1
+	if ps.histogram != expected {
+		t.Errorf("histogram is %+v, expected %+v", ps.histogram, expected)
+	}
+}
+
+func TestScaleStale(t *testing.T) {
+	_, update := stalenessServer(StalenessPolicy{Name: ScaleStale})
+	for i := 0; i < 4; i++ {
+		update(0, 0)
+	}
+
+	// The first update is fresh, the second is one update behind, which is not scaled, and the third four behind
+	for _, c := range []struct {
+		version uint64
+		moved   float64
+	}{{4, 1}, {4, 1}, {2, 1.0 / 4}} {
+		if moved := update(c.version, 1); math.Abs(moved-c.moved) > 1e-12 {
+			t.Errorf("update computed on version %d moved a parameter %f, expected %f", c.version, moved, c.moved)
+		}
+	}
+}
+
+func TestStaleMomentum(t *testing.T) {
+	_, update := stalenessServer(StalenessPolicy{Name: StaleMomentum, Momentum: 0.9})
+
+	// Fresh updates build up momentum, an update as stale as the momentum implies gets none
+	if moved := update(0, 1); math.Abs(moved-1) > 1e-12 {
+		t.Errorf("first update moved a parameter %f, expected 1", moved)
+	}
+	if moved := update(0, 1); math.Abs(moved-1.9) > 1e-12 {
+		t.Errorf("second fresh update moved a parameter %f, expected 1.9", moved)
+	}
+	for i := 0; i < 8; i++ {
+		update(0, 0)
+	}
+	if moved := update(1, 1); math.Abs(moved-1) > 1e-12 {
+		t.Errorf("update of staleness 9 moved a parameter %f, expected 1", moved)
+	}
+}
+
+func TestStalenessHistogram(t *testing.T) {
+	var h stalenessHistogram
+	for _, staleness := range []uint64{0, 0, 5, maxBucket, maxBucket + 10} {
+		h.record(staleness, false)
+	}
+	h.record(5, true)
+
+	if h.counts[0] != 2 || h.counts[5] != 2 || h.counts[maxBucket] != 2 || h.dropped != 1 {
+		t.Errorf("histogram is %+v", h)
+	}
+}
@@ -0,0 +1,63 @@
+package gossip
+
+import (
+	"log"
+	"math/rand"
+)
+
+// topologySeed is shared by every worker so that they all generate the same random graph
+const topologySeed int64 = 3200
+
+// edgeProbability is the chance of any two workers being joined in a random graph
+const edgeProbability float64 = 0.3
+
+// Neighbours returns the ranks that a worker may gossip with in a topology of size workers
+func Neighbours(topology string, rank int, size int) []int {
+	adjacent := make([][]bool, size)
+	for i := range adjacent {
+		adjacent[i] = make([]bool, size)
+	}
+
+	switch topology {
+	case "ring":
+		connectRing(adjacent)
+		break
+	case "random":
+		// A ring is included so that the random graph is always connected
+		connectRing(adjacent)
+		r := rand.New(rand.NewSource(topologySeed))
+		for i := 0; i < size; i++ {
+			for j := i + 1; j < size; j++ {
+				if r.Float64() < edgeProbability {
+					adjacent[i][j], adjacent[j][i] = true, true
+				}
+			}
+		}
+		break
+	case "full":
+		for i := 0; i < size; i++ {
+			for j := 0; j < size; j++ {
+				adjacent[i][j] = true
+			}
+		}
+		break
+	default:
+		log.Println("ERR: unknown topology", topology)
+	}
+
+	var neighbours []int
+	for i := 0; i < size; i++ {
+		if i != rank && adjacent[rank][i] {
+			neighbours = append(neighbours, i)
+		}
+	}
+	return neighbours
+}
+
+func connectRing(adjacent [][]bool) {
+	size := len(adjacent)
+	for i := 0; i < size; i++ {
+		next := (i + 1) % size
+		adjacent[i][next], adjacent[next][i] = true, true
+	}
+}
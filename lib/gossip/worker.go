@@ -0,0 +1,276 @@
+package gossip
+
+import (
+	"comp3200/lib"
+	"comp3200/lib/messenger"
+	"comp3200/lib/network"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// Worker is a struct that represents a decentralised gossip SGD worker
+type Worker struct {
+	model       *network.Network
+	rank        int
+	peers       []string
+	neighbours  []int
+	connections map[int]messenger.Messenger
+	heartbeats  map[int]func()
+
+	// mutex is held while training or averaging so that parameters are never replaced mid-step
+	mutex sync.Mutex
+}
+
+// LaunchWorker starts a gossip worker that averages parameters with a random neighbour every period mini-batches
+func LaunchWorker(address string, peers []string, topology string, period int, model *network.Network, data *network.Data) {
+	w := Worker{model: model, rank: -1, peers: peers, connections: make(map[int]messenger.Messenger), heartbeats: make(map[int]func())}
+	for i, peer := range peers {
+		if peer == address {
+			w.rank = i
+		}
+	}
+	if w.rank == -1 {
+		log.Println("ERR: address", address, "is not in the list of peers")
+		return
+	}
+	if period <= 0 {
+		log.Println("ERR: gossip period must be at least one mini-batch, not", period)
+		return
+	}
+	w.neighbours = Neighbours(topology, w.rank, len(peers))
+	log.Println("Launching gossip worker", w.rank, "with neighbours", w.neighbours)
+
+	l, err := messenger.Listen(address)
+	if err != nil {
+		log.Println("ERR:", err)
+		return
+	}
+	go w.listen(l)
+
+	// Every worker starts from the parameters of worker 0
+	if w.rank != 0 {
+		err = w.receiveParameters(0)
+		if err != nil {
+			log.Println("ERR: could not receive initial parameters", err)
+			return
+		}
+	}
+
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	partition := data.Partition(len(peers))[w.rank]
+	miniBatches := partition.GetMiniBatches(lib.MiniBatchSize)
+	idx := 0
+
+	// steps counts every mini-batch trained on, as idx starts again each epoch
+	steps := 0
+	for {
+		w.mutex.Lock()
+		w.model.TrainAndUpdate(miniBatches[idx])
+		w.mutex.Unlock()
+
+		idx++
+		if idx >= len(miniBatches) {
+			miniBatches = partition.GetMiniBatches(lib.MiniBatchSize)
+			idx = 0
+		}
+
+		steps++
+		if steps%period == 0 && len(w.neighbours) > 0 {
+			neighbour := w.neighbours[r.Intn(len(w.neighbours))]
+			err := w.average(neighbour)
+			if err != nil {
+				// Carry on training, another attempt will reconnect to the neighbour
+				log.Println("ERR: could not average with worker", neighbour, err)
+				w.disconnect(neighbour)
+			}
+		}
+	}
+}
+
+// connection returns the messenger used to contact a peer, connecting to it if this is the first contact
+func (w *Worker) connection(rank int) (messenger.Messenger, error) {
+	msg, ok := w.connections[rank]
+	if !ok {
+		var err error
+		msg, err = messenger.Connect(w.peers[rank])
+		if err != nil {
+			return msg, err
+		}
+		w.connections[rank] = msg
+
+		// Connections can sit idle between exchanges, so keep the peer from timing them out
+		w.heartbeats[rank] = msg.StartHeartbeat()
+	}
+	return msg, nil
+}
+
+// disconnect closes the connection to a peer so that the next contact reconnects
+func (w *Worker) disconnect(rank int) {
+	msg, ok := w.connections[rank]
+	if ok {
+		w.heartbeats[rank]()
+		msg.Close()
+		delete(w.connections, rank)
+		delete(w.heartbeats, rank)
+	}
+}
+
+func (w *Worker) listen(l net.Listener) {
+	err := messenger.Serve(l, w.handleConnection)
+	log.Println("ERR:", err)
+}
+
+func (w *Worker) handleConnection(msg messenger.Messenger) {
+	defer msg.Close()
+	for {
+		env, err := msg.Receive()
+
+		if err == nil {
+			switch env.Kind {
+			// Requesting parameters
+			case messenger.ParameterRequest:
+				err = w.handleParameterRequest(msg, env)
+				break
+			case messenger.AverageRequest:
+				err = w.handleAverageRequest(msg, env)
+				break
+			default:
+				err = messenger.Unexpected(env)
+			}
+		}
+
+		if errors.Is(err, messenger.ErrPeerClosed) {
+			log.Println("Worker disconnected")
+			return
+		} else if errors.Is(err, messenger.ErrTimeout) {
+			log.Println("Worker timed out, assuming it is dead")
+			return
+		} else if err != nil {
+			log.Println("ERR:", err)
+			return
+		}
+	}
+}
+
+func (w *Worker) handleParameterRequest(msg messenger.Messenger, request messenger.Envelope) error {
+	weights, biases := w.model.Parameters()
+	return msg.Reply(request, weights, biases)
+}
+
+func (w *Worker) handleAverageRequest(msg messenger.Messenger, request messenger.Envelope) error {
+	var theirWeights []mat.Dense
+	var theirBiases []mat.VecDense
+	err := request.Decode(&theirWeights, &theirBiases)
+	if err != nil {
+		return err
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	weights, biases := w.model.Parameters()
+	mine := network.FlattenParameters(weights, biases)
+	theirs := network.FlattenParameters(theirWeights, theirBiases)
+	err = sameLength(theirs, mine)
+	if err != nil {
+		return err
+	}
+
+	// Reply with our parameters before averaging so both sides compute the same average
+	err = msg.Reply(request, weights, biases)
+	if err != nil {
+		return err
+	}
+
+	for i := range mine {
+		mine[i] = (mine[i] + theirs[i]) / 2
+	}
+	network.UnflattenParameters(mine, weights, biases)
+	w.model.SetParameters(weights, biases)
+	return nil
+}
+
+// sameLength returns an error if a peer's parameters do not have as many elements as ours, as its model has a different shape
+func sameLength(theirs []float64, mine []float64) error {
+	if len(theirs) != len(mine) {
+		return fmt.Errorf("peer has %d parameters, model has %d", len(theirs), len(mine))
+	}
+	return nil
+}
+
+func (w *Worker) receiveParameters(rank int) error {
+	msg, err := w.connection(rank)
+	if err != nil {
+		return err
+	}
+
+	reply, err := msg.Request(messenger.ParameterRequest)
+	if err != nil {
+		return err
+	}
+
+	var weights []mat.Dense
+	var biases []mat.VecDense
+	err = reply.Decode(&weights, &biases)
+	if err != nil {
+		return err
+	}
+
+	w.mutex.Lock()
+	w.model.SetParameters(weights, biases)
+	w.mutex.Unlock()
+	return nil
+}
+
+// average exchanges parameters with a neighbour and moves this worker halfway towards them
+func (w *Worker) average(neighbour int) error {
+	msg, err := w.connection(neighbour)
+	if err != nil {
+		return err
+	}
+	weights, biases := w.model.Parameters()
+
+	reply, err := msg.Request(messenger.AverageRequest, weights, biases)
+	if err != nil {
+		return err
+	}
+
+	var theirWeights []mat.Dense
+	var theirBiases []mat.VecDense
+	err = reply.Decode(&theirWeights, &theirBiases)
+	if err != nil {
+		return err
+	}
+
+	sent := network.FlattenParameters(weights, biases)
+	theirs := network.FlattenParameters(theirWeights, theirBiases)
+	err = sameLength(theirs, sent)
+	if err != nil {
+		return err
+	}
+
+	// The lock is not held during the exchange to avoid deadlocking with a neighbour averaging with us,
+	// so apply the difference to whatever our parameters have become in the meantime
+	w.mutex.Lock()
+	weights, biases = w.model.Parameters()
+	current := network.FlattenParameters(weights, biases)
+	distance := 0.0
+	for i := range current {
+		diff := theirs[i] - sent[i]
+		distance += diff * diff
+		current[i] += diff / 2
+	}
+	network.UnflattenParameters(current, weights, biases)
+	w.model.SetParameters(weights, biases)
+	w.mutex.Unlock()
+
+	log.Printf("consensus,%d,%d,%f\n", w.rank, neighbour, math.Sqrt(distance))
+	return nil
+}
@@ -0,0 +1,167 @@
+package gossip
+
+import (
+	"comp3200/lib/messenger"
+	"comp3200/lib/network"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNeighbours(t *testing.T) {
+	if n := Neighbours("ring", 0, 5); !reflect.DeepEqual(n, []int{1, 4}) {
+		t.Errorf("ring neighbours of 0 were %v", n)
+	}
+	if n := Neighbours("full", 2, 4); !reflect.DeepEqual(n, []int{0, 1, 3}) {
+		t.Errorf("full neighbours of 2 were %v", n)
+	}
+
+	// Every worker builds the same random graph, which contains the ring
+	size := 10
+	adjacent := make(map[[2]int]bool)
+	for rank := 0; rank < size; rank++ {
+		for _, n := range Neighbours("random", rank, size) {
+			adjacent[[2]int{rank, n}] = true
+		}
+	}
+	for edge := range adjacent {
+		if !adjacent[[2]int{edge[1], edge[0]}] {
+			t.Errorf("%d is a neighbour of %d but not the other way round", edge[1], edge[0])
+		}
+	}
+	for rank := 0; rank < size; rank++ {
+		if !adjacent[[2]int{rank, (rank + 1) % size}] {
+			t.Errorf("random graph does not join %d to %d", rank, (rank+1)%size)
+		}
+	}
+}
+
+// workers counts the workers started, as a worker keeps its address until the process exits
+var workers int
+
+// listening starts a worker of model that serves requests from the others on an in-memory address and returns it
+func listening(t *testing.T, model *network.Network) (*Worker, string) {
+	workers++
+	address := fmt.Sprintf("%sgossip%d", messenger.MemoryScheme, workers)
+	l, err := messenger.Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &Worker{model: model, rank: workers, connections: make(map[int]messenger.Messenger), heartbeats: make(map[int]func())}
+	go w.listen(l)
+	return w, address
+}
+
+// requester returns a worker of model that contacts peers as rank 0
+func requester(model *network.Network, peers []string) *Worker {
+	return &Worker{model: model, peers: append([]string{""}, peers...), connections: make(map[int]messenger.Messenger), heartbeats: make(map[int]func())}
+}
+
+// parameters returns the parameters of a model as one vector
+func parameters(model *network.Network) []float64 {
+	return network.FlattenParameters(model.Parameters())
+}
+
+func TestAverage(t *testing.T) {
+	a := network.NewNetwork().WithLayer(4, 3, "sigmoid").WithLayer(3, 2, "softmax")
+	b := network.NewNetworkFromConfig(a.Config)
+	before, theirs := parameters(a), parameters(b)
+
+	_, address := listening(t, b)
+	w := requester(a, []string{address})
+	defer w.disconnect(1)
+	err := w.average(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both workers move halfway towards each other, the worker asked does so after replying
+	averaged := func(model *network.Network) bool {
+		for i, v := range parameters(model) {
+			if math.Abs(v-(before[i]+theirs[i])/2) > 1e-9 {
+				return false
+			}
+		}
+		return true
+	}
+	if !averaged(a) {
+		t.Error("worker that asked did not average")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !averaged(b) {
+		if time.Now().After(deadline) {
+			t.Fatal("worker asked did not average")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAverageDifferentModels(t *testing.T) {
+	a := network.NewNetwork().WithLayer(4, 3, "sigmoid").WithLayer(3, 2, "softmax")
+	b := network.NewNetwork().WithLayer(4, 5, "sigmoid").WithLayer(5, 2, "softmax")
+	before, theirs := parameters(a), parameters(b)
+
+	// The worker asked rejects the request, so neither worker's parameters change
+	_, address := listening(t, b)
+	w := requester(a, []string{address})
+	defer w.disconnect(1)
+	err := w.average(1)
+	if err == nil {
+		t.Error("averaged with a worker of a different model")
+	}
+	if !reflect.DeepEqual(parameters(a), before) || !reflect.DeepEqual(parameters(b), theirs) {
+		t.Error("parameters changed when averaging with a worker of a different model")
+	}
+
+	// A reply of a different model is rejected by the worker that asked
+	l, err := messenger.Listen(messenger.MemoryScheme + "gossipliar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		msg, err := messenger.Accept(conn)
+		if err != nil {
+			return
+		}
+		defer msg.Close()
+		request, err := msg.Receive()
+		if err == nil {
+			weights, biases := b.Parameters()
+			msg.Reply(request, weights, biases)
+			msg.Receive()
+		}
+	}()
+
+	w = requester(a, []string{messenger.MemoryScheme + "gossipliar"})
+	defer w.disconnect(1)
+	err = w.average(1)
+	if err == nil {
+		t.Error("averaged with a reply of a different model")
+	}
+	if !reflect.DeepEqual(parameters(a), before) {
+		t.Error("parameters changed when averaging with a reply of a different model")
+	}
+}
+
+func TestNoPeriod(t *testing.T) {
+	model := network.NewNetwork().WithLayer(4, 3, "sigmoid").WithLayer(3, 2, "softmax")
+	returned := make(chan bool)
+	go func() {
+		LaunchWorker(messenger.MemoryScheme+"gossipnoperiod", []string{messenger.MemoryScheme + "gossipnoperiod"}, "ring", 0, model, &network.Data{})
+		close(returned)
+	}()
+
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker with a period of zero did not refuse to start")
+	}
+}
@@ -1,18 +1,32 @@
 package lib
 
 import (
+	"comp3200/lib/messenger"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
 )
 
+// Tracing records a JSONL trace of every message next to the log file, TracingPayloads records the payloads in it too
+var Tracing bool
+var TracingPayloads bool
+
 // SetupLog sets up the log package to output to a particular file for this process
 func SetupLog(name string) {
-	filename := "log/" + name + strconv.Itoa(os.Getpid()) + ".log"
-	file, err := os.Create(filename)
+	filename := "log/" + name + strconv.Itoa(os.Getpid())
+	file, err := os.Create(filename + ".log")
 	if err != nil {
 		fmt.Println("Error setting up log file")
 	}
 	log.SetOutput(file)
+
+	if Tracing {
+		trace, err := os.Create(filename + ".jsonl")
+		if err != nil {
+			fmt.Println("Error setting up trace file")
+			return
+		}
+		messenger.StartTracing(trace, TracingPayloads)
+	}
 }
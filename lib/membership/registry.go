@@ -0,0 +1,170 @@
+package membership
+
+import (
+	"comp3200/lib/messenger"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Member is a struct that represents a model replica or client registered with a parameter server.
+// LastSeen is when the server last received a message or heartbeat from it
+type Member struct {
+	ID       uint64
+	Name     string
+	Address  string
+	Joined   time.Time
+	LastSeen time.Time
+}
+
+func (m Member) String() string {
+	return fmt.Sprintf("%d (%s at %s)", m.ID, m.Name, m.Address)
+}
+
+// ErrAlreadyJoined is returned when a connection that has already joined sends another join request
+var ErrAlreadyJoined = errors.New("already joined")
+
+// Registry is a struct that represents the members a parameter server is training with. A member registers with a join
+// request and deregisters with a leave request or when its connection is lost. The registry does not check liveness itself:
+// a member's connection times out if neither messages nor heartbeats arrive on it, and the server deregisters the member then
+type Registry struct {
+	mutex   sync.Mutex
+	members map[uint64]Member
+	nextID  uint64
+}
+
+// NewRegistry creates a registry with no members
+func NewRegistry() *Registry {
+	return &Registry{members: make(map[uint64]Member), nextID: 1}
+}
+
+// Register adds a member and returns it with the id it was given
+func (r *Registry) Register(name string, address string) Member {
+	r.mutex.Lock()
+	now := time.Now()
+	member := Member{ID: r.nextID, Name: name, Address: address, Joined: now, LastSeen: now}
+	r.nextID++
+	r.members[member.ID] = member
+	count := len(r.members)
+	r.mutex.Unlock()
+
+	log.Println("Member", member, "joined,", count, "members")
+	return member
+}
+
+// Deregister removes a member, returning false if it was not registered
+func (r *Registry) Deregister(id uint64) bool {
+	r.mutex.Lock()
+	member, ok := r.members[id]
+	delete(r.members, id)
+	count := len(r.members)
+	r.mutex.Unlock()
+
+	if ok {
+		log.Println("Member", member, "left,", count, "members")
+	}
+	return ok
+}
+
+// Seen records that a message was received from a member, it does nothing if the member is not registered
+func (r *Registry) Seen(id uint64) {
+	r.mutex.Lock()
+	if member, ok := r.members[id]; ok {
+		member.LastSeen = time.Now()
+		r.members[id] = member
+	}
+	r.mutex.Unlock()
+}
+
+// Members returns every registered member in the order they joined
+func (r *Registry) Members() []Member {
+	r.mutex.Lock()
+	members := make([]Member, 0, len(r.members))
+	for _, member := range r.members {
+		members = append(members, member)
+	}
+	r.mutex.Unlock()
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ID < members[j].ID
+	})
+	return members
+}
+
+// Len returns the number of registered members
+func (r *Registry) Len() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.members)
+}
+
+// HandleJoin registers the peer that sent a join request and replies with its membership. joined is the membership the
+// connection already has, a connection that has joined may not join again and keeps its membership
+func (r *Registry) HandleJoin(msg messenger.Messenger, request messenger.Envelope, joined Member) (Member, error) {
+	if joined.ID != 0 {
+		return joined, fmt.Errorf("%w as member %s", ErrAlreadyJoined, joined)
+	}
+
+	var name string
+	err := request.Decode(&name)
+	if err != nil {
+		return Member{}, err
+	}
+
+	member := r.Register(name, msg.Peer())
+	return member, msg.Reply(request, member)
+}
+
+// HandleLeave deregisters a member that sent a leave request and acknowledges it, after which the member may close its connection
+func (r *Registry) HandleLeave(msg messenger.Messenger, request messenger.Envelope, id uint64) error {
+	r.Deregister(id)
+	return msg.Reply(request)
+}
+
+// HandleMemberRequest replies with every registered member
+func (r *Registry) HandleMemberRequest(msg messenger.Messenger, request messenger.Envelope) error {
+	return msg.Reply(request, r.Members())
+}
+
+// DefaultName returns the name a member gives itself when joining, its host and process
+func DefaultName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s/%d", host, os.Getpid())
+}
+
+// Join registers with the server at the other end of msg and returns the membership it was given
+func Join(msg messenger.Messenger, name string) (Member, error) {
+	reply, err := msg.Request(messenger.Join, name)
+	if err != nil {
+		return Member{}, err
+	}
+
+	var member Member
+	err = reply.Decode(&member)
+	return member, err
+}
+
+// Leave deregisters from the server at the other end of msg, waiting until it has done so
+func Leave(msg messenger.Messenger) error {
+	_, err := msg.Request(messenger.Leave)
+	return err
+}
+
+// Members asks the server at the other end of msg for every member registered with it
+func Members(msg messenger.Messenger) ([]Member, error) {
+	reply, err := msg.Request(messenger.MemberRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	var members []Member
+	err = reply.Decode(&members)
+	return members, err
+}
@@ -0,0 +1,153 @@
+package membership
+
+import (
+	"comp3200/lib/messenger"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// serve handles join, leave and member requests on the server end of a pipe until it closes, recording heartbeats as
+// the parameter servers do, and returns the client end
+func serve(t *testing.T, r *Registry) messenger.Messenger {
+	client, server := net.Pipe()
+	go func() {
+		msg := messenger.NewMessenger(server)
+		defer msg.Close()
+		var member Member
+		msg.OnHeartbeat(func() {
+			r.Seen(member.ID)
+		})
+		for {
+			env, err := msg.Receive()
+			if err != nil {
+				return
+			}
+			switch env.Kind {
+			case messenger.Join:
+				member, err = r.HandleJoin(msg, env, member)
+			case messenger.Leave:
+				err = r.HandleLeave(msg, env, member.ID)
+				member = Member{}
+			case messenger.MemberRequest:
+				err = r.HandleMemberRequest(msg, env)
+			default:
+				err = messenger.Unexpected(env)
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	return messenger.NewMessenger(client)
+}
+
+func TestRegister(t *testing.T) {
+	r := NewRegistry()
+	a := r.Register("a", "here")
+	b := r.Register("b", "there")
+	if a.ID == 0 || b.ID == a.ID {
+		t.Fatalf("members were given ids %d and %d", a.ID, b.ID)
+	}
+	if members := r.Members(); len(members) != 2 || members[0] != a || members[1] != b || r.Len() != 2 {
+		t.Fatalf("registry held %v", members)
+	}
+
+	// Seen moves LastSeen on, and ignores members that are not registered
+	time.Sleep(time.Millisecond)
+	r.Seen(a.ID)
+	r.Seen(b.ID + 1)
+	if members := r.Members(); !members[0].LastSeen.After(a.LastSeen) || members[0].Joined != a.Joined {
+		t.Errorf("member seen was last seen %v, joined %v", members[0].LastSeen, a.LastSeen)
+	}
+
+	if !r.Deregister(a.ID) {
+		t.Error("did not deregister a registered member")
+	}
+	if r.Deregister(a.ID) {
+		t.Error("deregistered a member twice")
+	}
+	if members := r.Members(); len(members) != 1 || members[0] != b || r.Len() != 1 {
+		t.Errorf("registry held %v after deregistering %s", members, a)
+	}
+
+	// Ids are not reused once a member leaves
+	if c := r.Register("c", "elsewhere"); c.ID == a.ID || c.ID == b.ID {
+		t.Errorf("new member was given id %d already used", c.ID)
+	}
+}
+
+func TestJoinTwice(t *testing.T) {
+	r := NewRegistry()
+	joined := r.Register("a", "here")
+
+	// The join is refused before anything is read or sent, so no connection is needed
+	member, err := r.HandleJoin(messenger.Messenger{}, messenger.Envelope{Kind: messenger.Join}, joined)
+	if !errors.Is(err, ErrAlreadyJoined) {
+		t.Errorf("second join returned error %v", err)
+	}
+	if member != joined || r.Len() != 1 {
+		t.Errorf("second join left membership %s with %d members", member, r.Len())
+	}
+}
+
+func TestJoinAndLeave(t *testing.T) {
+	r := NewRegistry()
+	msg := serve(t, r)
+	defer msg.Close()
+
+	member, err := Join(msg, "replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if member.ID == 0 || member.Name != "replica" {
+		t.Errorf("joined as %s", member)
+	}
+	members, err := Members(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].ID != member.ID || members[0].Name != member.Name {
+		t.Errorf("members were %v after joining as %s", members, member)
+	}
+
+	// The leave is acknowledged only once the member has been deregistered
+	err = Leave(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 0 {
+		t.Errorf("registry held %v after leaving", r.Members())
+	}
+	members, err = Members(msg)
+	if err != nil || len(members) != 0 {
+		t.Errorf("members were %v with error %v after leaving", members, err)
+	}
+}
+
+func TestHeartbeatSeen(t *testing.T) {
+	r := NewRegistry()
+	msg := serve(t, r)
+	defer msg.Close()
+
+	member, err := Join(msg, "idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	// A heartbeat never reaches the server's handler but still counts as seeing the member
+	err = msg.Send(messenger.Heartbeat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	members, err := Members(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || !members[0].LastSeen.After(member.LastSeen) {
+		t.Errorf("members were %v after a heartbeat from %s last seen %v", members, member, member.LastSeen)
+	}
+}
@@ -0,0 +1,292 @@
+package messenger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// Codec identifies how the values in a message payload are serialized.
+// The first byte of every payload names its codec, so each end of a connection may choose its own
+type Codec byte
+
+// Every codec a payload may be encoded with
+const (
+	// Gob serializes every value with encoding/gob
+	Gob Codec = iota
+	// Float64 writes parameter tensors as raw little-endian float64 buffers with shape headers, other values use gob
+	Float64
+	// Float32 is Float64 at half the size, losing precision beyond float32
+	Float32
+)
+
+// DefaultCodec is the codec used by new messengers
+var DefaultCodec = Gob
+
+// ParseCodec returns the codec with the given name
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case "gob":
+		return Gob, nil
+	case "float64":
+		return Float64, nil
+	case "float32":
+		return Float32, nil
+	}
+	return Gob, fmt.Errorf("unknown codec %q", name)
+}
+
+func (c Codec) String() string {
+	switch c {
+	case Gob:
+		return "gob"
+	case Float64:
+		return "float64"
+	case Float32:
+		return "float32"
+	}
+	return fmt.Sprintf("codec(%d)", byte(c))
+}
+
+// The tag written before each value by the tensor codecs
+const (
+	tagGob byte = iota
+	tagDenses
+	tagVecDenses
+	tagFloats
+)
+
+var errUnknownCodec = errors.New("unknown codec")
+
+// encode serializes each value in order into a single payload
+func (c Codec) encode(vs []interface{}) ([]byte, error) {
+	if len(vs) == 0 {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(byte(c))
+
+	if c == Gob {
+		enc := gob.NewEncoder(&buf)
+		for _, v := range vs {
+			err := enc.Encode(v)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return buf.Bytes(), nil
+	}
+
+	size := 8
+	if c == Float32 {
+		size = 4
+	}
+	for _, v := range vs {
+		var err error
+		switch t := v.(type) {
+		case []mat.Dense:
+			buf.WriteByte(tagDenses)
+			writeLength(&buf, len(t))
+			for i := range t {
+				rows, cols := t[i].Dims()
+				writeLength(&buf, rows)
+				writeLength(&buf, cols)
+				raw := t[i].RawMatrix()
+				for r := 0; r < rows; r++ {
+					writeFloats(&buf, raw.Data[r*raw.Stride:r*raw.Stride+cols], size)
+				}
+			}
+		case []mat.VecDense:
+			buf.WriteByte(tagVecDenses)
+			writeLength(&buf, len(t))
+			for i := range t {
+				writeLength(&buf, t[i].Len())
+				writeFloats(&buf, mat.Col(nil, 0, &t[i]), size)
+			}
+		case []float64:
+			buf.WriteByte(tagFloats)
+			writeLength(&buf, len(t))
+			writeFloats(&buf, t, size)
+		default:
+			// Anything other than a parameter tensor is rare and small, so gob is good enough
+			var section bytes.Buffer
+			err = gob.NewEncoder(&section).Encode(v)
+			buf.WriteByte(tagGob)
+			writeLength(&buf, section.Len())
+			buf.Write(section.Bytes())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// decodePayload deserializes a payload written by any codec into each value in order
+func decodePayload(payload []byte, vs []interface{}) error {
+	if len(vs) == 0 {
+		return nil
+	}
+	if len(payload) == 0 {
+		return io.ErrUnexpectedEOF
+	}
+
+	r := bytes.NewReader(payload[1:])
+	switch Codec(payload[0]) {
+	case Gob:
+		dec := gob.NewDecoder(r)
+		for _, v := range vs {
+			err := dec.Decode(v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case Float64, Float32:
+		size := 8
+		if Codec(payload[0]) == Float32 {
+			size = 4
+		}
+		for _, v := range vs {
+			err := decodeTensor(r, v, size)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%w %d", errUnknownCodec, payload[0])
+}
+
+// decodeTensor reads one tagged value written by a tensor codec into v
+func decodeTensor(r *bytes.Reader, v interface{}, size int) error {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	n, err := readLength(r)
+	if err != nil {
+		return err
+	}
+
+	switch tag {
+	case tagGob:
+		section := make([]byte, n)
+		_, err = io.ReadFull(r, section)
+		if err != nil {
+			return err
+		}
+		return gob.NewDecoder(bytes.NewReader(section)).Decode(v)
+	case tagDenses:
+		t, ok := v.(*[]mat.Dense)
+		if !ok {
+			return fmt.Errorf("received []mat.Dense, expected %T", v)
+		}
+		*t = make([]mat.Dense, n)
+		for i := range *t {
+			rows, err := readLength(r)
+			if err != nil {
+				return err
+			}
+			cols, err := readLength(r)
+			if err != nil {
+				return err
+			}
+			if rows == 0 || cols == 0 {
+				continue
+			}
+			data, err := readFloats(r, rows*cols, size)
+			if err != nil {
+				return err
+			}
+			(*t)[i] = *mat.NewDense(rows, cols, data)
+		}
+		return nil
+	case tagVecDenses:
+		t, ok := v.(*[]mat.VecDense)
+		if !ok {
+			return fmt.Errorf("received []mat.VecDense, expected %T", v)
+		}
+		*t = make([]mat.VecDense, n)
+		for i := range *t {
+			length, err := readLength(r)
+			if err != nil {
+				return err
+			}
+			if length == 0 {
+				continue
+			}
+			data, err := readFloats(r, length, size)
+			if err != nil {
+				return err
+			}
+			(*t)[i] = *mat.NewVecDense(length, data)
+		}
+		return nil
+	case tagFloats:
+		t, ok := v.(*[]float64)
+		if !ok {
+			return fmt.Errorf("received []float64, expected %T", v)
+		}
+		*t, err = readFloats(r, n, size)
+		return err
+	}
+	return fmt.Errorf("unknown value tag %d", tag)
+}
+
+func writeLength(buf *bytes.Buffer, n int) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(n))
+	buf.Write(b[:])
+}
+
+func readLength(r *bytes.Reader) (int, error) {
+	var b [4]byte
+	_, err := io.ReadFull(r, b[:])
+	if err != nil {
+		return 0, err
+	}
+	n := int(binary.LittleEndian.Uint32(b[:]))
+
+	// A corrupt length must not cause a huge allocation
+	if n > r.Len() {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
+
+func writeFloats(buf *bytes.Buffer, fs []float64, size int) {
+	b := make([]byte, len(fs)*size)
+	for i, f := range fs {
+		if size == 4 {
+			binary.LittleEndian.PutUint32(b[i*4:], math.Float32bits(float32(f)))
+		} else {
+			binary.LittleEndian.PutUint64(b[i*8:], math.Float64bits(f))
+		}
+	}
+	buf.Write(b)
+}
+
+func readFloats(r *bytes.Reader, n int, size int) ([]float64, error) {
+	if n*size > r.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n*size)
+	io.ReadFull(r, b)
+
+	fs := make([]float64, n)
+	for i := range fs {
+		if size == 4 {
+			fs[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(b[i*4:])))
+		} else {
+			fs[i] = math.Float64frombits(binary.LittleEndian.Uint64(b[i*8:]))
+		}
+	}
+	return fs, nil
+}
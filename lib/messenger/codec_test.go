@@ -0,0 +1,95 @@
+package messenger
+
+import (
+	"comp3200/lib/network"
+	"math"
+	"testing"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// parameters returns the weights and biases of the 784-300-100-10 model used in the comparison
+func parameters() ([]mat.Dense, []mat.VecDense) {
+	model := network.NewNetwork().WithLayer(784, 300, "sigmoid").WithLayer(300, 100, "sigmoid").WithLayer(100, 10, "softmax")
+	return model.Parameters()
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	weights, biases := parameters()
+	flat := network.FlattenParameters(weights, biases)
+	config := network.NetworkConfig{LearningRate: 0.5}
+
+	for _, codec := range []Codec{Gob, Float64, Float32} {
+		payload, err := codec.encode([]interface{}{weights, biases, flat[:10], config})
+		if err != nil {
+			t.Fatal(codec, err)
+		}
+
+		var w []mat.Dense
+		var b []mat.VecDense
+		var f []float64
+		var c network.NetworkConfig
+		err = decodePayload(payload, []interface{}{&w, &b, &f, &c})
+		if err != nil {
+			t.Fatal(codec, err)
+		}
+
+		// Float32 only keeps about 7 significant digits
+		tolerance := 0.0
+		if codec == Float32 {
+			tolerance = 1e-6
+		}
+		got := network.FlattenParameters(w, b)
+		for i := range flat {
+			if math.Abs(got[i]-flat[i]) > tolerance*math.Max(1, math.Abs(flat[i])) {
+				t.Fatalf("%s: parameter %d is %v, sent %v", codec, i, got[i], flat[i])
+			}
+		}
+		if len(f) != 10 || c.LearningRate != config.LearningRate {
+			t.Fatalf("%s: decoded %v and %v", codec, f, c)
+		}
+	}
+}
+
+func TestCodecTypeMismatch(t *testing.T) {
+	weights, _ := parameters()
+	payload, err := Float64.encode([]interface{}{weights})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var biases []mat.VecDense
+	err = decodePayload(payload, []interface{}{&biases})
+	if err == nil {
+		t.Fatal("decoded []mat.Dense into []mat.VecDense")
+	}
+}
+
+func benchmarkEncode(b *testing.B, codec Codec) {
+	weights, biases := parameters()
+	b.ResetTimer()
+	var payload []byte
+	for i := 0; i < b.N; i++ {
+		payload, _ = codec.encode([]interface{}{weights, biases})
+	}
+	b.ReportMetric(float64(len(payload)), "wire-bytes")
+}
+
+func benchmarkDecode(b *testing.B, codec Codec) {
+	weights, biases := parameters()
+	payload, _ := codec.encode([]interface{}{weights, biases})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var w []mat.Dense
+		var v []mat.VecDense
+		decodePayload(payload, []interface{}{&w, &v})
+	}
+	b.ReportMetric(float64(len(payload)), "wire-bytes")
+}
+
+func BenchmarkEncodeGob(b *testing.B)     { benchmarkEncode(b, Gob) }
+func BenchmarkEncodeFloat64(b *testing.B) { benchmarkEncode(b, Float64) }
+func BenchmarkEncodeFloat32(b *testing.B) { benchmarkEncode(b, Float32) }
+
+func BenchmarkDecodeGob(b *testing.B)     { benchmarkDecode(b, Gob) }
+func BenchmarkDecodeFloat64(b *testing.B) { benchmarkDecode(b, Float64) }
+func BenchmarkDecodeFloat32(b *testing.B) { benchmarkDecode(b, Float32) }
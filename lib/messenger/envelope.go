@@ -0,0 +1,62 @@
+package messenger
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ProtocolVersion is the version of the envelope protocol spoken by this binary, peers must agree on it when connecting
+const ProtocolVersion = 8
+
+// Kind identifies what a message is asking for or carrying
+type Kind string
+
+// Every kind of message in the protocol
+const (
+	Hello            Kind = "HLO"
+	Reply            Kind = "RES"
+	Authenticate     Kind = "AUT"
+	ModelRequest     Kind = "MDL"
+	ParameterRequest Kind = "REQ"
+	ParameterUpdate  Kind = "UPD"
+	Continue         Kind = "CON"
+	Snapshot         Kind = "SNP"
+	ReplicatedUpdate Kind = "RPL"
+	AverageRequest   Kind = "AVG"
+	DataRequest      Kind = "DAT"
+	Partition        Kind = "PRT"
+	Chunk            Kind = "CHK"
+	Join             Kind = "JON"
+	Leave            Kind = "LEV"
+	MemberRequest    Kind = "MEM"
+)
+
+// Envelope is a struct that represents a single message sent between system entities.
+// Seq counts every envelope sent on a connection, starting at 1. A request that expects a reply carries its own Seq
+// as its RequestID and the reply carries the same RequestID, other messages have a RequestID of 0
+type Envelope struct {
+	Kind      Kind
+	Seq       uint64
+	RequestID uint64
+	Payload   []byte
+}
+
+// ErrVersionMismatch is returned when a peer speaks a different version of the protocol
+var ErrVersionMismatch = errors.New("protocol version mismatch")
+
+// ErrUnexpectedMessage is returned when a peer sends a message that is not valid at that point in the protocol
+var ErrUnexpectedMessage = errors.New("unexpected message")
+
+// Unexpected returns an error describing a message that the receiver did not expect
+func Unexpected(env Envelope) error {
+	return fmt.Errorf("%w: %s (seq %d, request %d)", ErrUnexpectedMessage, env.Kind, env.Seq, env.RequestID)
+}
+
+// Decode deserializes the payload of this envelope into each value in order, stopping at the first error
+func (env Envelope) Decode(vs ...interface{}) error {
+	err := decodePayload(env.Payload, vs)
+	if err != nil {
+		return &DecodeError{fmt.Sprintf("%s payload", env.Kind), err}
+	}
+	return nil
+}
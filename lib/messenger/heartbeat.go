@@ -0,0 +1,55 @@
+package messenger
+
+import (
+	"sync"
+	"time"
+)
+
+// Heartbeat is the kind of message sent to show that a peer is still alive, it is skipped by Receive
+const Heartbeat Kind = "HBT"
+
+// HeartbeatInterval is how often peers that send heartbeats do so, zero disables heartbeats.
+// It should be well below Timeout so that a live but idle peer is never mistaken for a dead one
+var HeartbeatInterval time.Duration
+
+// OnHeartbeat sets a function that Receive calls, in the receiving goroutine, for each heartbeat it skips,
+// so that the receiver can tell an idle peer is alive without heartbeats reaching it as messages
+func (m *Messenger) OnHeartbeat(f func()) {
+	m.state.onHeartbeat = f
+}
+
+// StartHeartbeat sends a heartbeat every HeartbeatInterval until the returned function is called or sending fails.
+// Heartbeats must only be sent to a peer that reads messages with Receive, and the returned function does not
+// return until the last heartbeat has been sent
+func (m *Messenger) StartHeartbeat() func() {
+	if HeartbeatInterval <= 0 {
+		return func() {}
+	}
+
+	msg := *m
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(HeartbeatInterval)
+		defer ticker.Stop()
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if msg.Send(Heartbeat) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			<-done
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package messenger
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// withHeartbeats sets Timeout and HeartbeatInterval until the returned function is called
+func withHeartbeats(timeout time.Duration, interval time.Duration) func() {
+	oldTimeout, oldInterval := Timeout, HeartbeatInterval
+	Timeout, HeartbeatInterval = timeout, interval
+	return func() {
+		Timeout, HeartbeatInterval = oldTimeout, oldInterval
+	}
+}
+
+// receiving starts a server on an in-memory address that reports what the first receive on each connection returns
+func receiving(t *testing.T, name string) (chan error, func() error) {
+	l, err := Listen(MemoryScheme + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan error, 1)
+	go Serve(l, func(msg Messenger) {
+		defer msg.Close()
+		_, err := msg.Receive()
+		received <- err
+	})
+	return received, l.Close
+}
+
+func TestHungPeerTimesOut(t *testing.T) {
+	defer withHeartbeats(100*time.Millisecond, 0)()
+
+	// The server completes the handshake and then sends nothing
+	l, err := Listen(MemoryScheme + "hung")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	hung := make(chan bool)
+	defer close(hung)
+	go Serve(l, func(msg Messenger) {
+		<-hung
+		msg.Close()
+	})
+
+	msg, err := Connect(MemoryScheme + "hung")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer msg.Close()
+
+	start := time.Now()
+	_, err = msg.Receive()
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("receiving from a hung peer failed with %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < Timeout/2 || elapsed > 10*Timeout {
+		t.Errorf("receiving from a hung peer gave up after %v, Timeout is %v", elapsed, Timeout)
+	}
+}
+
+func TestHeartbeatKeepsAlive(t *testing.T) {
+	defer withHeartbeats(100*time.Millisecond, 20*time.Millisecond)()
+	received, stop := receiving(t, "idle")
+	defer stop()
+
+	msg, err := Connect(MemoryScheme + "idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer msg.Close()
+	stopHeartbeat := msg.StartHeartbeat()
+
+	// The peer stays idle for several timeouts, but its heartbeats keep the server from giving up on it
+	time.Sleep(5 * Timeout)
+	select {
+	case err := <-received:
+		t.Fatalf("server gave up on an idle peer sending heartbeats with %v", err)
+	default:
+	}
+	stopHeartbeat()
+	err = msg.Send(Join, "idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-received:
+		if err != nil {
+			t.Errorf("server failed to receive from an idle peer with %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("server did not receive from an idle peer")
+	}
+}
@@ -0,0 +1,290 @@
+package messenger
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Link is a struct that represents the conditions of an emulated network link, applied to the data this process sends over it
+type Link struct {
+	// Latency is the mean one-way delay, Jitter its spread under Distribution
+	Latency      time.Duration
+	Jitter       time.Duration
+	Distribution string
+
+	// Bandwidth caps the link in bytes per second, zero means uncapped
+	Bandwidth float64
+
+	// DropRate is the probability that sending a message drops the connection
+	DropRate float64
+}
+
+// Latency distributions
+const (
+	Constant    = "constant"
+	Uniform     = "uniform"
+	Normal      = "normal"
+	Exponential = "exponential"
+)
+
+// Presets are named links for common scenarios
+var Presets = map[string]Link{
+	"datacentre": {Latency: 200 * time.Microsecond, Jitter: 50 * time.Microsecond, Distribution: Normal, Bandwidth: 1.25e9},
+	"wan":        {Latency: 40 * time.Millisecond, Jitter: 10 * time.Millisecond, Distribution: Normal, Bandwidth: 12.5e6},
+	"flaky":      {Latency: 20 * time.Millisecond, Jitter: 30 * time.Millisecond, Distribution: Exponential, Bandwidth: 2.5e6, DropRate: 0.001},
+}
+
+// ParseLink parses a preset name or comma-separated settings, e.g. "latency=40ms,jitter=10ms,dist=normal,bandwidth=12.5M,drop=0.001".
+// Bandwidth is in bytes per second and may end in K, M or G
+func ParseLink(spec string) (Link, error) {
+	if preset, ok := Presets[spec]; ok {
+		return preset, nil
+	}
+
+	link := Link{Distribution: Constant}
+	for _, setting := range strings.Split(spec, ",") {
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 {
+			return Link{}, fmt.Errorf("link setting %q is not of the form key=value", setting)
+		}
+
+		var err error
+		switch parts[0] {
+		case "latency":
+			link.Latency, err = time.ParseDuration(parts[1])
+		case "jitter":
+			link.Jitter, err = time.ParseDuration(parts[1])
+		case "dist":
+			link.Distribution = parts[1]
+			if parts[1] != Constant && parts[1] != Uniform && parts[1] != Normal && parts[1] != Exponential {
+				err = fmt.Errorf("unknown distribution")
+			}
+		case "bandwidth":
+			link.Bandwidth, err = parseBandwidth(parts[1])
+		case "drop":
+			link.DropRate, err = strconv.ParseFloat(parts[1], 64)
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+		if err != nil {
+			return Link{}, fmt.Errorf("link setting %q: %v", setting, err)
+		}
+	}
+	return link, nil
+}
+
+func parseBandwidth(s string) (float64, error) {
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1e3
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1e6
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1e9
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+	bandwidth, err := strconv.ParseFloat(s, 64)
+	return bandwidth * multiplier, err
+}
+
+// delay samples the one-way delay of a message
+func (l Link) delay() time.Duration {
+	jitter := float64(l.Jitter)
+	var d float64
+	switch l.Distribution {
+	case Uniform:
+		d = float64(l.Latency) + (2*rand.Float64()-1)*jitter
+	case Normal:
+		d = float64(l.Latency) + rand.NormFloat64()*jitter
+	case Exponential:
+		d = float64(l.Latency) + rand.ExpFloat64()*jitter
+	default:
+		d = float64(l.Latency)
+	}
+	if d < 0 {
+		return 0
+	}
+	return time.Duration(d)
+}
+
+var links = struct {
+	sync.RWMutex
+	enabled  bool
+	fallback Link
+	peers    map[string]Link
+}{peers: make(map[string]Link)}
+
+// SetDefaultLink sets the conditions of every link without a peer-specific one
+func SetDefaultLink(link Link) {
+	links.Lock()
+	links.fallback = link
+	links.enabled = true
+	links.Unlock()
+}
+
+// SetLink sets the conditions of the link to a peer, matched against the address dialed or the host of an accepted connection.
+// Changes apply immediately to connections made while any link was set
+func SetLink(address string, link Link) {
+	links.Lock()
+	links.peers[address] = link
+	links.enabled = true
+	links.Unlock()
+}
+
+// lookupLink returns the conditions of the link to a peer
+func lookupLink(address string, remote net.Addr) Link {
+	links.RLock()
+	defer links.RUnlock()
+	if link, ok := links.peers[address]; ok && address != "" {
+		return link
+	}
+	if remote != nil {
+		if link, ok := links.peers[remote.String()]; ok {
+			return link
+		}
+		host, _, err := net.SplitHostPort(remote.String())
+		if link, ok := links.peers[host]; ok && err == nil {
+			return link
+		}
+	}
+	return links.fallback
+}
+
+// emulate wraps a connection in a link emulator if any link has been set, address is the address dialed or "" if accepted
+func emulate(conn net.Conn, address string) net.Conn {
+	links.RLock()
+	enabled := links.enabled
+	links.RUnlock()
+	if !enabled {
+		return conn
+	}
+
+	c := &emulatedConn{Conn: conn, address: address, queue: make(chan packet, 1024), stop: make(chan struct{})}
+	go c.deliver()
+	return c
+}
+
+// packet is a struct that represents data waiting to arrive at the other end of an emulated link
+type packet struct {
+	data    []byte
+	arrival time.Time
+}
+
+// emulatedConn is a struct that represents a connection whose writes are delayed, paced and dropped according to a Link.
+// writeMutex keeps writes in order while one waits for room in the queue, mutex guards the rest and is never held while waiting
+type emulatedConn struct {
+	net.Conn
+	address string
+
+	writeMutex sync.Mutex
+	mutex      sync.Mutex
+	queue      chan packet
+	stop       chan struct{}
+	closed     bool
+	err        error
+
+	// free is when the link finishes transmitting what has been written, last is the arrival of the last packet
+	free time.Time
+	last time.Time
+}
+
+func (c *emulatedConn) Write(p []byte) (int, error) {
+	link := lookupLink(c.address, c.RemoteAddr())
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.mutex.Lock()
+	if c.closed || c.err != nil {
+		err := c.err
+		c.mutex.Unlock()
+		if err == nil {
+			err = io.ErrClosedPipe
+		}
+		return 0, err
+	}
+
+	if link.DropRate > 0 && rand.Float64() < link.DropRate {
+		log.Println("Emulated link to", c.RemoteAddr(), "dropped the connection")
+		c.err = io.ErrClosedPipe
+		c.mutex.Unlock()
+		c.Close()
+		return 0, io.ErrClosedPipe
+	}
+
+	// Transmission is serialised at the link's bandwidth, then every packet is delayed but never overtakes an earlier one
+	now := time.Now()
+	if c.free.Before(now) {
+		c.free = now
+	}
+	if link.Bandwidth > 0 {
+		c.free = c.free.Add(time.Duration(float64(len(p)) / link.Bandwidth * float64(time.Second)))
+	}
+	arrival := c.free.Add(link.delay())
+	if arrival.Before(c.last) {
+		arrival = c.last
+	}
+	c.last = arrival
+	free := c.free
+	c.mutex.Unlock()
+
+	data := make([]byte, len(p))
+	copy(data, p)
+	select {
+	case c.queue <- packet{data, arrival}:
+	case <-c.stop:
+		return 0, io.ErrClosedPipe
+	}
+
+	// The sender is held up for as long as the link takes to transmit, but not for the delay
+	time.Sleep(time.Until(free))
+	return len(p), nil
+}
+
+// deliver writes each packet to the real connection once it is due to arrive, until the connection is closed
+func (c *emulatedConn) deliver() {
+	for {
+		var pkt packet
+		select {
+		case pkt = <-c.queue:
+		case <-c.stop:
+			return
+		}
+
+		timer := time.NewTimer(time.Until(pkt.arrival))
+		select {
+		case <-timer.C:
+		case <-c.stop:
+			timer.Stop()
+			return
+		}
+
+		_, err := c.Conn.Write(pkt.data)
+		if err != nil {
+			c.mutex.Lock()
+			c.err = err
+			c.mutex.Unlock()
+		}
+	}
+}
+
+// Close closes the real connection, dropping whatever is still on its way as a real connection would
+func (c *emulatedConn) Close() error {
+	c.mutex.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.stop)
+	}
+	c.mutex.Unlock()
+	return c.Conn.Close()
+}
@@ -0,0 +1,122 @@
+package messenger
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// withLink emulates every link as link until the returned function is called
+func withLink(link Link) func() {
+	SetDefaultLink(link)
+	return func() {
+		links.Lock()
+		links.enabled = false
+		links.fallback = Link{}
+		links.Unlock()
+	}
+}
+
+func TestEmulatedCloseDropsQueue(t *testing.T) {
+	defer withLink(Link{Latency: time.Hour, Distribution: Constant})()
+
+	client, server := net.Pipe()
+	defer server.Close()
+	c := emulate(client, "").(*emulatedConn)
+
+	// Fill the queue with packets that will not arrive for an hour, the write after that waits for room
+	written := make(chan error, 1)
+	go func() {
+		for {
+			_, err := c.Write([]byte{1})
+			if err != nil {
+				written <- err
+				return
+			}
+		}
+	}()
+	for len(c.queue) < cap(c.queue) {
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- c.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close waited for queued packets")
+	}
+
+	select {
+	case err := <-written:
+		if err != io.ErrClosedPipe {
+			t.Errorf("write waiting for room failed with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write waiting for room was not released by close")
+	}
+}
+
+func TestEmulatedWriteFailure(t *testing.T) {
+	defer withLink(Link{Distribution: Constant})()
+
+	client, server := net.Pipe()
+	c := emulate(client, "").(*emulatedConn)
+	defer c.Close()
+
+	// Once the peer has gone the failed delivery is reported by a later write, even while writers are waiting for room
+	server.Close()
+	failed := make(chan error, 1)
+	go func() {
+		for {
+			_, err := c.Write([]byte{1})
+			if err != nil {
+				failed <- err
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-failed:
+		if err != io.ErrClosedPipe {
+			t.Errorf("write to a closed peer failed with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write to a closed peer did not fail")
+	}
+}
+
+func TestEmulatedDelivery(t *testing.T) {
+	defer withLink(Link{Latency: 20 * time.Millisecond, Distribution: Constant})()
+
+	client, server := net.Pipe()
+	defer server.Close()
+	c := emulate(client, "")
+	defer c.Close()
+
+	start := time.Now()
+	for i := byte(0); i < 3; i++ {
+		_, err := c.Write([]byte{i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := make([]byte, 1)
+	for i := byte(0); i < 3; i++ {
+		_, err := io.ReadFull(server, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf[0] != i {
+			t.Errorf("packet %d arrived as %d", i, buf[0])
+		}
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Errorf("packets arrived after %v, before the link's latency", time.Since(start))
+	}
+}
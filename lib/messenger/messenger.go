@@ -1,92 +1,400 @@
 package messenger
 
 import (
-	"comp3200/lib"
+	"bufio"
+	"bytes"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
-	"reflect"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Messenger is a struct that represents a two-way connection between system entities
 type Messenger struct {
-	enc *gob.Encoder
-	dec *gob.Decoder
+	conn  net.Conn
+	enc   *gob.Encoder
+	dec   *gob.Decoder
+	state *state
 }
 
-var received int
-var sent int
+// state is a struct that holds the settings shared by every copy of a messenger
+type state struct {
+	timeout time.Duration
+	codec   Codec
 
-// Connect connects this messenger to another messenger on an IPv4 address
-func Connect(address string) Messenger {
-	conn, err := net.Dial("tcp4", address)
+	// id, peer and local identify the connection in traces
+	id    uint64
+	peer  string
+	local string
+
+	// The connection is read through a counter and each envelope is encoded into buffer before it is written,
+	// so that the size of every message is known
+	traffic traffic
+	reader  *countingReader
+	buffer  bytes.Buffer
+
+	// sendMutex is held while numbering and writing an envelope so that envelopes are written in sequence order
+	sendMutex  sync.Mutex
+	sendSeq    uint64
+	receiveSeq uint64
+
+	// onHeartbeat is called by Receive for each heartbeat it skips
+	onHeartbeat func()
+}
+
+// Timeout is the default deadline for each send or receive on a new messenger, zero means no deadline
+var Timeout time.Duration
+
+// ErrPeerClosed is returned when the other end of a messenger's connection has gone away
+var ErrPeerClosed = errors.New("peer closed connection")
+
+// ErrTimeout is returned when a messenger operation does not complete before its deadline
+var ErrTimeout = errors.New("operation timed out")
+
+// DecodeError is returned when a received value cannot be decoded into the type the receiver expected
+type DecodeError struct {
+	Expected string
+	Err      error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("could not decode %s: %v", e.Expected, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// ConnectTimeout is how long Connect keeps retrying an address that is not accepting connections
+var ConnectTimeout = 30 * time.Second
+
+// maxBackoff caps the wait between connection attempts
+const maxBackoff = 2 * time.Second
+
+// Connect connects this messenger to another messenger on an address of any transport, retrying for up to ConnectTimeout
+func Connect(address string) (Messenger, error) {
+	return ConnectWithDeadline(address, time.Now().Add(ConnectTimeout))
+}
+
+// ConnectWithDeadline connects to an address, retrying with exponential backoff until the deadline passes,
+// and then agrees the protocol version with the peer
+func ConnectWithDeadline(address string, deadline time.Time) (Messenger, error) {
+	backoff := 50 * time.Millisecond
+	for {
+		conn, err := dial(address)
+		if err == nil {
+			m := NewMessenger(emulate(conn, address))
+			m.state.peer = address
+			err = m.hello(sharedSecret())
+			if err != nil {
+				m.Close()
+				return Messenger{}, fmt.Errorf("handshake with %s failed: %w", address, err)
+			}
+			return m, nil
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			return Messenger{}, fmt.Errorf("could not connect to %s: %w", address, err)
+		}
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// hello sends our protocol version to the peer that accepted the connection and checks that it replies with the same one.
+// If either side has a shared secret, each then proves to the other that it knows it
+func (m *Messenger) hello(secret []byte) error {
+	var nonce []byte
+	if secret != nil {
+		var err error
+		nonce, err = newNonce()
+		if err != nil {
+			return err
+		}
+	}
+
+	env, err := m.Request(Hello, ProtocolVersion, nonce)
+	if err != nil {
+		return err
+	}
+
+	// Older peers reply with only their version, so check it before decoding anything else
+	var version int
+	err = env.Decode(&version)
+	if err != nil {
+		return err
+	}
+	if version != ProtocolVersion {
+		return fmt.Errorf("%w: we speak version %d, peer speaks version %d", ErrVersionMismatch, ProtocolVersion, version)
+	}
+
+	var challenge, serverProof []byte
+	err = env.Decode(&version, &challenge, &serverProof)
 	if err != nil {
-		fmt.Println("Error creating messenger. Could not connect to ", address, err)
-		panic(1)
+		return err
 	}
-	return NewMessenger(conn)
+	return m.authenticateServer(secret, nonce, challenge, serverProof)
 }
 
-// NewMessenger creates a new messenger using a TCP connection
-func NewMessenger(conn net.Conn) Messenger {
-	return Messenger{gob.NewEncoder(conn), gob.NewDecoder(conn)}
+// Accept creates a messenger on a connection accepted from a listener and agrees the protocol version with the peer.
+// If we have a shared secret the peer must prove it knows it before any other message is processed.
+// The connection is closed if the peer does not speak our version or fails to authenticate
+func Accept(conn net.Conn) (Messenger, error) {
+	return accept(NewMessenger(emulate(conn, "")), sharedSecret())
+}
+
+// Serve accepts connections on l until it fails, returning the error. Each peer is handshaken with in its own goroutine,
+// so that one that connects and says nothing does not hold up the rest, and its messenger is then passed to handle
+func Serve(l net.Listener, handle func(msg Messenger)) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			msg, err := Accept(conn)
+			if err != nil {
+				log.Println("ERR: handshake failed", err)
+				return
+			}
+			handle(msg)
+		}()
+	}
 }
 
-// ReceiveInterface instructs this messenger that it will receive a serialized interface
-func (m *Messenger) ReceiveInterface(v interface{}) {
-	SimulateLatency()
-	err := m.dec.Decode(v)
+// accept performs the accepting side of the handshake on a new messenger
+func accept(m Messenger, secret []byte) (Messenger, error) {
+	env, err := m.Receive()
+	if err == nil && env.Kind != Hello {
+		err = Unexpected(env)
+	}
+
+	var version int
+	if err == nil {
+		err = env.Decode(&version)
+	}
+	var nonce []byte
+	if err == nil && version == ProtocolVersion {
+		err = env.Decode(&version, &nonce)
+	}
+
+	var challenge, serverProof []byte
+	if err == nil && secret != nil {
+		challenge, err = newNonce()
+		serverProof = proof(secret, "server", nonce, challenge)
+	}
+
+	// Always reply with our version so that the peer can report the mismatch too
+	if err == nil {
+		err = m.Reply(env, ProtocolVersion, challenge, serverProof)
+	}
+	if err == nil && version != ProtocolVersion {
+		err = fmt.Errorf("%w: we speak version %d, peer speaks version %d", ErrVersionMismatch, ProtocolVersion, version)
+	}
+	if err == nil && secret != nil {
+		err = m.authenticateClient(secret, nonce, challenge)
+	}
+
 	if err != nil {
-		fmt.Println("Error receiving interface", err)
-		panic(err)
+		m.Close()
+		return Messenger{}, err
 	}
-	logReceiveMessage(reflect.TypeOf(v).String())
+	return m, nil
 }
 
-// ReceiveMessage instructs this messenger that it will receive a command string
-func (m *Messenger) ReceiveMessage(cmd *string) {
-	var temp string
-	SimulateLatency()
-	err := m.dec.Decode(&temp)
+// NewMessenger creates a new messenger using a TCP connection, without agreeing a protocol version
+func NewMessenger(conn net.Conn) Messenger {
+	s := &state{timeout: Timeout, codec: DefaultCodec, id: nextConnection(), peer: conn.RemoteAddr().String(), local: conn.LocalAddr().String(), reader: &countingReader{r: bufio.NewReader(conn)}}
+	return Messenger{conn, gob.NewEncoder(&s.buffer), gob.NewDecoder(s.reader), s}
+}
+
+// Peer returns the address of the other end of this messenger's connection, as dialed or as accepted
+func (m *Messenger) Peer() string {
+	return m.state.peer
+}
+
+// SetTimeout sets the deadline for each send or receive on this messenger, zero means no deadline
+func (m *Messenger) SetTimeout(timeout time.Duration) {
+	m.state.timeout = timeout
+}
+
+// SetCodec sets the codec used for the payloads this messenger sends, the peer decodes whichever codec it receives
+func (m *Messenger) SetCodec(codec Codec) {
+	m.state.codec = codec
+}
+
+func (m *Messenger) setReadDeadline() {
+	if m.state.timeout > 0 {
+		m.conn.SetReadDeadline(time.Now().Add(m.state.timeout))
+	}
+}
+
+func (m *Messenger) setWriteDeadline() {
+	if m.state.timeout > 0 {
+		m.conn.SetWriteDeadline(time.Now().Add(m.state.timeout))
+	}
+}
+
+// Close closes the connection underlying this messenger
+func (m *Messenger) Close() error {
+	if m.conn == nil {
+		return nil
+	}
+	return m.conn.Close()
+}
+
+// connectionError converts an error from the underlying connection into ErrPeerClosed or ErrTimeout where possible
+func connectionError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %v", ErrTimeout, err)
+	}
+	var opErr *net.OpError
+	if err == io.EOF || err == io.ErrUnexpectedEOF || err == io.ErrClosedPipe || errors.As(err, &opErr) {
+		return fmt.Errorf("%w: %v", ErrPeerClosed, err)
+	}
+	return err
+}
+
+// Receive waits for the next envelope from the peer, heartbeats are skipped after being passed to the OnHeartbeat hook
+func (m *Messenger) Receive() (Envelope, error) {
+	var env Envelope
+	for {
+		m.setReadDeadline()
+
+		// gob leaves fields that are zero in the message untouched, so start from an empty envelope each time
+		env = Envelope{}
+		before := m.state.reader.n
+		err := m.dec.Decode(&env)
+		if err != nil {
+			converted := connectionError(err)
+			if converted == err {
+				converted = &DecodeError{"envelope", err}
+			}
+			return Envelope{}, converted
+		}
+		size := m.state.reader.n - before
+		m.state.traffic.recordReceived(env.Kind, size)
+		total.recordReceived(env.Kind, size)
+		m.traceEnvelope(DirectionReceived, env, size)
+
+		// Every envelope is numbered by its sender, so a gap means the stream is corrupt
+		m.state.receiveSeq++
+		if env.Seq != m.state.receiveSeq {
+			return Envelope{}, fmt.Errorf("%w: %s out of sequence, expected %d got %d", ErrUnexpectedMessage, env.Kind, m.state.receiveSeq, env.Seq)
+		}
+		if env.Kind != Heartbeat {
+			break
+		}
+		if m.state.onHeartbeat != nil {
+			m.state.onHeartbeat()
+		}
+	}
+
+	logReceiveMessage(string(env.Kind))
+	return env, nil
+}
+
+// Expect receives the next envelope, which must be of the given kind, and decodes its payload into vs
+func (m *Messenger) Expect(kind Kind, vs ...interface{}) error {
+	env, err := m.Receive()
 	if err != nil {
-		fmt.Println("Error receiving command", err)
-		panic(err)
+		return err
+	}
+	if env.Kind != kind {
+		return Unexpected(env)
 	}
-	*cmd = strings.TrimSpace(temp)
+	return env.Decode(vs...)
+}
 
-	received++
-	logReceiveMessage(*cmd)
+// send numbers an envelope and writes it to the connection as a single unit
+func (m *Messenger) send(kind Kind, request bool, requestID uint64, vs []interface{}) (uint64, error) {
+	payload, err := m.state.codec.encode(vs)
+	if err != nil {
+		return 0, err
+	}
+	return m.sendPayload(kind, request, requestID, payload)
 }
 
-// SendInterface instructs this messenger to send an interface
-func (m *Messenger) SendInterface(v interface{}) {
-	err := m.enc.Encode(v)
+// sendPayload numbers an envelope around an encoded payload and writes it to the connection
+func (m *Messenger) sendPayload(kind Kind, request bool, requestID uint64, payload []byte) (uint64, error) {
+	m.state.sendMutex.Lock()
+	defer m.state.sendMutex.Unlock()
+	m.state.sendSeq++
+	env := Envelope{kind, m.state.sendSeq, requestID, payload}
+	if request {
+		env.RequestID = env.Seq
+	}
+
+	m.state.buffer.Reset()
+	err := m.enc.Encode(&env)
 	if err != nil {
-		fmt.Println("Error sending interface", err)
-		panic(err)
+		return 0, err
 	}
-	logSendMessage(reflect.TypeOf(v).String())
+	size := int64(m.state.buffer.Len())
+
+	// The envelope is traced before it is written so that a trace never shows the peer's response to it first
+	m.traceEnvelope(DirectionSent, env, size)
+
+	m.setWriteDeadline()
+	_, err = m.conn.Write(m.state.buffer.Bytes())
+	if err != nil {
+		return 0, connectionError(err)
+	}
+	m.state.traffic.recordSent(kind, size)
+	total.recordSent(kind, size)
+	if kind != Heartbeat {
+		logSendMessage(string(kind))
+	}
+	return env.RequestID, nil
 }
 
-// SendMessage instructs this messenger to send a command
-func (m *Messenger) SendMessage(msg string) {
-	err := m.enc.Encode(msg)
+// Send sends a message of the given kind that does not expect a reply, with vs serialized in order as its payload
+func (m *Messenger) Send(kind Kind, vs ...interface{}) error {
+	_, err := m.send(kind, false, 0, vs)
+	return err
+}
+
+// SendRequest sends a message that expects a reply and returns its request ID without waiting for the reply.
+// Several requests may be in flight on one connection, their replies arrive in the order they were sent
+func (m *Messenger) SendRequest(kind Kind, vs ...interface{}) (uint64, error) {
+	return m.send(kind, true, 0, vs)
+}
+
+// ReceiveReply waits for the reply to the request with the given ID
+func (m *Messenger) ReceiveReply(requestID uint64) (Envelope, error) {
+	env, err := m.Receive()
 	if err != nil {
-		fmt.Println("Error sending command", err)
-		panic(err)
+		return Envelope{}, err
+	}
+	if env.Kind != Reply || env.RequestID != requestID {
+		return Envelope{}, fmt.Errorf("awaiting reply to request %d: %w", requestID, Unexpected(env))
 	}
-	sent++
-	logSendMessage(msg)
+	return env, nil
 }
 
-// SimulateLatency causes the current thread to sleep for the amount specified by latency
-func SimulateLatency() {
-	if lib.SimulatingLatency {
-		time.Sleep(lib.Latency * time.Millisecond)
+// Request sends a message that expects a reply and waits for the reply
+func (m *Messenger) Request(kind Kind, vs ...interface{}) (Envelope, error) {
+	id, err := m.SendRequest(kind, vs...)
+	if err != nil {
+		return Envelope{}, err
 	}
+	return m.ReceiveReply(id)
+}
+
+// Reply answers a request received from the peer, with vs serialized in order as its payload
+func (m *Messenger) Reply(request Envelope, vs ...interface{}) error {
+	_, err := m.send(Reply, false, request.RequestID, vs)
+	return err
 }
 
 var loggingMessages bool
@@ -108,26 +416,22 @@ func StartLoggingMessages() {
 	loggingMessages = true
 }
 
-// TakeReceived returns the number of received messages and resets it
+// TakeReceived returns the number of messages received by every messenger and resets it
 func TakeReceived() int {
-	temp := received
-	received = 0
-	return temp
+	return int(atomic.SwapInt64(&total.received.messages, 0))
 }
 
-// TakeSent returns the number of sent messages and resets it
+// TakeSent returns the number of messages sent by every messenger and resets it
 func TakeSent() int {
-	temp := sent
-	sent = 0
-	return temp
+	return int(atomic.SwapInt64(&total.sent.messages, 0))
 }
 
-// Received returns the number of received messages
+// Received returns the number of messages received by every messenger, including heartbeats
 func Received() int {
-	return received
+	return int(atomic.LoadInt64(&total.received.messages))
 }
 
-// Sent returns the number of sent messages
+// Sent returns the number of messages sent by every messenger, including heartbeats
 func Sent() int {
-	return sent
+	return int(atomic.LoadInt64(&total.sent.messages))
 }
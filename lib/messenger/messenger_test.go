@@ -0,0 +1,166 @@
+package messenger
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestVersionMismatch(t *testing.T) {
+	// A client of another version is refused by the server, which still tells it the version it speaks
+	client, server := net.Pipe()
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := accept(NewMessenger(server), nil)
+		accepted <- err
+	}()
+
+	c := NewMessenger(client)
+	defer c.Close()
+	reply, err := c.Request(Hello, ProtocolVersion+1, []byte(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var version int
+	err = reply.Decode(&version)
+	if err != nil || version != ProtocolVersion {
+		t.Errorf("server replied with version %d and error %v", version, err)
+	}
+	select {
+	case err = <-accepted:
+		if !errors.Is(err, ErrVersionMismatch) {
+			t.Errorf("server accepted another version with error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server did not refuse another version")
+	}
+
+	// A server of another version is refused by the client as soon as it replies
+	client, server = net.Pipe()
+	go func() {
+		s := NewMessenger(server)
+		defer s.Close()
+		request, err := s.Receive()
+		if err == nil {
+			s.Reply(request, ProtocolVersion+1, []byte(nil), []byte(nil))
+		}
+	}()
+
+	c = NewMessenger(client)
+	defer c.Close()
+	start := time.Now()
+	err = c.hello(nil)
+	if !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("client accepted another version with error %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("client took %v to refuse another version", time.Since(start))
+	}
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	client, server := net.Pipe()
+	c, s := NewMessenger(client), NewMessenger(server)
+	defer c.Close()
+	defer s.Close()
+
+	// The server answers only once every request has arrived, each with the number it carried doubled
+	served := make(chan error, 1)
+	go func() {
+		var requests []Envelope
+		for len(requests) < 3 {
+			request, err := s.Receive()
+			if err != nil {
+				served <- err
+				return
+			}
+			requests = append(requests, request)
+		}
+		for _, request := range requests {
+			var v int
+			err := request.Decode(&v)
+			if err == nil {
+				err = s.Reply(request, 2*v)
+			}
+			if err != nil {
+				served <- err
+				return
+			}
+		}
+		served <- nil
+	}()
+
+	var ids []uint64
+	for v := 1; v <= 3; v++ {
+		id, err := c.SendRequest(DataRequest, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	// Waiting for the second reply first finds the first, which must be refused rather than taken for it
+	_, err := c.ReceiveReply(ids[1])
+	if !errors.Is(err, ErrUnexpectedMessage) {
+		t.Errorf("reply to request %d was taken for the reply to %d with error %v", ids[0], ids[1], err)
+	}
+	for i, id := range ids[1:] {
+		reply, err := c.ReceiveReply(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v int
+		err = reply.Decode(&v)
+		if err != nil || v != 2*(i+2) {
+			t.Errorf("reply to request %d decoded to %d with error %v, expected %d", id, v, err, 2*(i+2))
+		}
+	}
+	err = <-served
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServe(t *testing.T) {
+	l, err := Listen(MemoryScheme + "serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handled := make(chan string, 2)
+	go Serve(l, func(msg Messenger) {
+		defer msg.Close()
+		var name string
+		err := msg.Expect(Join, &name)
+		if err == nil {
+			handled <- name
+		}
+	})
+
+	// A peer that connects and says nothing does not hold up the next
+	silent, err := Memory.Dial("serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	msg, err := Connect(MemoryScheme + "serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer msg.Close()
+	err = msg.Send(Join, "talkative")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case name := <-handled:
+		if name != "talkative" {
+			t.Errorf("handled %q", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("peer was not handled while another said nothing")
+	}
+
+	l.Close()
+}
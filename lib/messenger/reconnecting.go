@@ -0,0 +1,107 @@
+package messenger
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ReconnectTimeout is how long a reconnecting messenger retries an address before moving on to the next one
+var ReconnectTimeout = 5 * time.Second
+
+var errNoAddresses = errors.New("no addresses left to reconnect to")
+
+// Reconnecting is a struct that represents a messenger that re-establishes its session when the connection is lost.
+// It sends heartbeats while connected, so the peer must read messages with Receive
+type Reconnecting struct {
+	msg           Messenger
+	addresses     []string
+	handshake     func(msg Messenger) error
+	stopHeartbeat func()
+}
+
+// ConnectReconnecting connects to the first of a list of addresses and performs a handshake, which is repeated on every reconnection.
+// Later addresses are only used once reconnecting to an earlier one fails, handshake may be nil
+func ConnectReconnecting(addresses []string, handshake func(msg Messenger) error) (*Reconnecting, error) {
+	r := Reconnecting{addresses: addresses, handshake: handshake}
+
+	var err error
+	r.msg, err = Connect(addresses[0])
+	if err == nil {
+		err = r.shake()
+	}
+	if err != nil {
+		log.Println("Could not connect to", addresses[0], err)
+		r.addresses = r.addresses[1:]
+		err = r.reconnect(err)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &r, nil
+}
+
+// shake performs the handshake on a new connection and starts sending heartbeats on it
+func (r *Reconnecting) shake() error {
+	if r.handshake != nil {
+		err := r.handshake(r.msg)
+		if err != nil {
+			r.msg.Close()
+			return fmt.Errorf("handshake with %s failed: %w", r.addresses[0], err)
+		}
+	}
+	r.stopHeartbeat = r.msg.StartHeartbeat()
+	return nil
+}
+
+// Do runs f with the current connection, reconnecting and running f again if the connection was lost.
+// f must be safe to repeat, as the peer may have acted on it before the connection failed
+func (r *Reconnecting) Do(f func(msg Messenger) error) error {
+	if len(r.addresses) == 0 {
+		return errNoAddresses
+	}
+
+	err := f(r.msg)
+	for errors.Is(err, ErrPeerClosed) || errors.Is(err, ErrTimeout) {
+		log.Println("Lost connection to", r.addresses[0], err)
+		r.Close()
+
+		err = r.reconnect(err)
+		if err != nil {
+			return err
+		}
+		err = f(r.msg)
+	}
+	return err
+}
+
+// reconnect re-establishes the session with the current address, moving on to the next address if that fails.
+// cause is why the last connection failed, and the error returned once every address has failed wraps the last failure
+func (r *Reconnecting) reconnect(cause error) error {
+	for len(r.addresses) > 0 {
+		var err error
+		r.msg, err = ConnectWithDeadline(r.addresses[0], time.Now().Add(ReconnectTimeout))
+		if err == nil {
+			err = r.shake()
+		}
+		if err == nil {
+			log.Println("Reconnected to", r.addresses[0])
+			return nil
+		}
+
+		log.Println("Could not reconnect to", r.addresses[0], err)
+		r.addresses = r.addresses[1:]
+		cause = err
+	}
+	return fmt.Errorf("%v: %w", errNoAddresses, cause)
+}
+
+// Close stops sending heartbeats and closes the current connection
+func (r *Reconnecting) Close() error {
+	if r.stopHeartbeat != nil {
+		r.stopHeartbeat()
+		r.stopHeartbeat = nil
+	}
+	return r.msg.Close()
+}
@@ -0,0 +1,205 @@
+package messenger
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echoServer is a struct that represents a server on an in-memory address that replies to every request with the number it carries
+type echoServer struct {
+	mutex    sync.Mutex
+	conns    []Messenger
+	accepted int
+	stop     func() error
+}
+
+// listenEcho starts an echo server on an in-memory address
+func listenEcho(t *testing.T, name string) *echoServer {
+	l, err := Listen(MemoryScheme + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &echoServer{stop: l.Close}
+	go Serve(l, func(msg Messenger) {
+		s.mutex.Lock()
+		s.conns = append(s.conns, msg)
+		s.accepted++
+		s.mutex.Unlock()
+
+		defer msg.Close()
+		for {
+			request, err := msg.Receive()
+			var v int
+			if err == nil {
+				err = request.Decode(&v)
+			}
+			if err == nil {
+				err = msg.Reply(request, v)
+			}
+			if err != nil {
+				return
+			}
+		}
+	})
+	return s
+}
+
+// drop closes every connection to the server, which keeps listening
+func (s *echoServer) drop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, msg := range s.conns {
+		msg.Close()
+	}
+	s.conns = nil
+}
+
+// kill closes the server's listener and every connection to it
+func (s *echoServer) kill() {
+	s.stop()
+	s.drop()
+}
+
+// handshakes returns a handshake that counts how often it runs, and the count
+func handshakes() (func(msg Messenger) error, *int) {
+	count := 0
+	return func(msg Messenger) error {
+		count++
+		_, err := msg.Request(DataRequest, 0)
+		return err
+	}, &count
+}
+
+// echo asks r's peer to echo v and checks that it did
+func echo(t *testing.T, r *Reconnecting, v int) error {
+	return r.Do(func(msg Messenger) error {
+		reply, err := msg.Request(DataRequest, v)
+		if err != nil {
+			return err
+		}
+		var got int
+		err = reply.Decode(&got)
+		if err == nil && got != v {
+			t.Errorf("peer echoed %d, sent %d", got, v)
+		}
+		return err
+	})
+}
+
+// withTimeouts shortens how long connections are retried until the returned function is called
+func withTimeouts() func() {
+	connect, reconnect := ConnectTimeout, ReconnectTimeout
+	ConnectTimeout, ReconnectTimeout = 200*time.Millisecond, 200*time.Millisecond
+	return func() {
+		ConnectTimeout, ReconnectTimeout = connect, reconnect
+	}
+}
+
+func TestConnectBackoff(t *testing.T) {
+	// A server that starts listening while a peer is backing off is connected to
+	late := make(chan *echoServer, 1)
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		late <- listenEcho(t, "late")
+	}()
+	msg, err := ConnectWithDeadline(MemoryScheme+"late", time.Now().Add(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Close()
+	(<-late).kill()
+
+	// A server that never listens is given up on at the deadline
+	start := time.Now()
+	_, err = ConnectWithDeadline(MemoryScheme+"never", time.Now().Add(300*time.Millisecond))
+	if !errors.Is(err, errConnectionRefused) {
+		t.Errorf("connecting to nothing failed with %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("gave up after %v, the deadline was 300ms", elapsed)
+	}
+}
+
+func TestReconnectHandshake(t *testing.T) {
+	defer withTimeouts()()
+	s := listenEcho(t, "flaky")
+	defer s.kill()
+	handshake, count := handshakes()
+	r, err := ConnectReconnecting([]string{MemoryScheme + "flaky"}, handshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Losing the connection mid-session reconnects, saying hello and running the handshake again
+	err = echo(t, r, 1)
+	if err == nil {
+		s.drop()
+		err = echo(t, r, 2)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mutex.Lock()
+	accepted := s.accepted
+	s.mutex.Unlock()
+	if accepted != 2 || *count != 2 {
+		t.Errorf("server accepted %d connections and the handshake ran %d times, expected 2 of each", accepted, *count)
+	}
+}
+
+func TestReconnectNextAddress(t *testing.T) {
+	defer withTimeouts()()
+	primary := listenEcho(t, "primary")
+	backup := listenEcho(t, "backup")
+	defer backup.kill()
+	handshake, count := handshakes()
+	r, err := ConnectReconnecting([]string{MemoryScheme + "primary", MemoryScheme + "backup"}, handshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	err = echo(t, r, 1)
+	if err == nil {
+		primary.kill()
+		err = echo(t, r, 2)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup.mutex.Lock()
+	defer backup.mutex.Unlock()
+	if backup.accepted != 1 || *count != 2 {
+		t.Errorf("backup accepted %d connections and the handshake ran %d times, expected 1 and 2", backup.accepted, *count)
+	}
+}
+
+func TestReconnectGivesUp(t *testing.T) {
+	defer withTimeouts()()
+
+	// The only address failing is reported with why it failed
+	_, err := ConnectReconnecting([]string{MemoryScheme + "nobody"}, nil)
+	if !errors.Is(err, errConnectionRefused) || !strings.Contains(err.Error(), errNoAddresses.Error()) {
+		t.Errorf("connecting to nothing failed with %v", err)
+	}
+
+	s := listenEcho(t, "dying")
+	r, err := ConnectReconnecting([]string{MemoryScheme + "dying"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	err = echo(t, r, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.kill()
+	err = echo(t, r, 2)
+	if !errors.Is(err, errConnectionRefused) || !strings.Contains(err.Error(), errNoAddresses.Error()) {
+		t.Errorf("reconnecting to a dead server failed with %v", err)
+	}
+}
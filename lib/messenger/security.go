@@ -0,0 +1,277 @@
+package messenger
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Files that LoadTLS reads from and GenerateCertificates writes to a directory
+const (
+	CAFile   = "ca.pem"
+	CertFile = "node.pem"
+	KeyFile  = "node-key.pem"
+)
+
+// ErrUnauthenticated is returned when a peer does not prove that it knows the shared secret
+var ErrUnauthenticated = errors.New("authentication failed")
+
+// security holds the TLS configurations and shared secret applied to every connection made or accepted in this process
+var security = struct {
+	sync.RWMutex
+	server *tls.Config
+	client *tls.Config
+	secret []byte
+}{}
+
+// LoadTLS enables mutual TLS on every connection, using the certificate authority, certificate and key in a directory.
+// Peers are trusted if their certificate is signed by the authority, host names are not checked as nodes often share one certificate
+func LoadTLS(dir string) error {
+	server, client, err := loadTLSConfigs(dir)
+	if err != nil {
+		return err
+	}
+
+	security.Lock()
+	security.server, security.client = server, client
+	security.Unlock()
+	return nil
+}
+
+// loadTLSConfigs builds the configurations for accepting and dialing connections from the files in a directory
+func loadTLSConfigs(dir string) (*tls.Config, *tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, CertFile), filepath.Join(dir, KeyFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load certificate: %w", err)
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(dir, CAFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load certificate authority: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, nil, fmt.Errorf("no certificates found in %s", filepath.Join(dir, CAFile))
+	}
+
+	// Session tickets are disabled because they are written after the handshake, which blocks on synchronous in-memory connections
+	server := &tls.Config{
+		Certificates:           []tls.Certificate{cert},
+		ClientAuth:             tls.RequireAndVerifyClientCert,
+		ClientCAs:              pool,
+		SessionTicketsDisabled: true,
+	}
+	client := &tls.Config{
+		Certificates:          []tls.Certificate{cert},
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyChain(pool),
+	}
+	return server, client, nil
+}
+
+// verifyChain checks that the certificate a server presents is signed by the authority, standing in for the
+// verification that InsecureSkipVerify turns off so that the server's host name is not checked
+func verifyChain(pool *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("server presented no certificate")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{Roots: pool, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+		return err
+	}
+}
+
+// SetSecret requires every connection to prove knowledge of a shared secret when it is made, nil turns the requirement off
+func SetSecret(secret []byte) {
+	security.Lock()
+	security.secret = secret
+	security.Unlock()
+}
+
+func tlsConfigs() (*tls.Config, *tls.Config) {
+	security.RLock()
+	defer security.RUnlock()
+	return security.server, security.client
+}
+
+func sharedSecret() []byte {
+	security.RLock()
+	defer security.RUnlock()
+	return security.secret
+}
+
+// secureListener wraps a listener in TLS if it has been enabled
+func secureListener(l net.Listener) net.Listener {
+	server, _ := tlsConfigs()
+	if server == nil {
+		return l
+	}
+	return tls.NewListener(l, server)
+}
+
+// secureConn wraps a dialed connection in TLS if it has been enabled, the handshake happens on the first read or write
+func secureConn(conn net.Conn) net.Conn {
+	_, client := tlsConfigs()
+	if client == nil {
+		return conn
+	}
+	return tls.Client(conn, client)
+}
+
+// nonceSize is the length of the random challenges exchanged when authenticating
+const nonceSize = 32
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// proof returns the HMAC of both challenges under the shared secret. The role keeps a proof made by one side
+// from being reflected back as the other side's
+func proof(secret []byte, role string, challenge []byte, own []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(role))
+	mac.Write(challenge)
+	mac.Write(own)
+	return mac.Sum(nil)
+}
+
+// authenticateServer checks the challenge and proof a peer replied to our hello with, then answers the challenge.
+// Authentication is mutual, so a peer that does not challenge us when we have a secret is rejected too
+func (m *Messenger) authenticateServer(secret []byte, nonce []byte, challenge []byte, serverProof []byte) error {
+	if len(challenge) == 0 && secret == nil {
+		return nil
+	}
+	if secret == nil {
+		return fmt.Errorf("%w: peer requires a shared secret", ErrUnauthenticated)
+	}
+	if len(challenge) != nonceSize || !hmac.Equal(serverProof, proof(secret, "server", nonce, challenge)) {
+		return fmt.Errorf("%w: peer did not prove it knows the shared secret", ErrUnauthenticated)
+	}
+
+	_, err := m.Request(Authenticate, proof(secret, "client", challenge, nonce))
+	if errors.Is(err, ErrPeerClosed) {
+		return fmt.Errorf("%w: peer rejected our proof: %v", ErrUnauthenticated, err)
+	}
+	return err
+}
+
+// authenticateClient receives a peer's answer to the challenge sent in reply to its hello
+func (m *Messenger) authenticateClient(secret []byte, nonce []byte, challenge []byte) error {
+	env, err := m.Receive()
+	if err != nil {
+		return err
+	}
+	if env.Kind != Authenticate {
+		return fmt.Errorf("%w: expected proof of the shared secret, got %v", ErrUnauthenticated, Unexpected(env))
+	}
+
+	var clientProof []byte
+	err = env.Decode(&clientProof)
+	if err != nil {
+		return err
+	}
+	if len(nonce) != nonceSize || !hmac.Equal(clientProof, proof(secret, "client", challenge, nonce)) {
+		return fmt.Errorf("%w: peer did not prove it knows the shared secret", ErrUnauthenticated)
+	}
+	return m.Reply(env)
+}
+
+// GenerateCertificates writes a new certificate authority and a certificate and key signed by it to a directory,
+// to be copied to every node and loaded with LoadTLS. The authority's key is discarded, so adding nodes means generating a new set
+func GenerateCertificates(dir string) error {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	caTemplate, err := certificateTemplate("comp3200 certificate authority")
+	if err != nil {
+		return err
+	}
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template, err := certificateTemplate("comp3200 node")
+	if err != nil {
+		return err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	template.DNSNames = []string{"localhost"}
+	template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = writePEM(filepath.Join(dir, CAFile), "CERTIFICATE", caDER, 0644)
+	if err == nil {
+		err = writePEM(filepath.Join(dir, CertFile), "CERTIFICATE", der, 0644)
+	}
+	if err == nil {
+		err = writePEM(filepath.Join(dir, KeyFile), "EC PRIVATE KEY", keyDER, 0600)
+	}
+	return err
+}
+
+func certificateTemplate(name string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+	}, nil
+}
+
+func writePEM(path string, blockType string, der []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), perm)
+}
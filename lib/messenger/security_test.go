@@ -0,0 +1,180 @@
+package messenger
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+// handshake runs both sides of the handshake over a pipe with the given secrets and returns the error each side saw
+func handshake(t *testing.T, client net.Conn, server net.Conn, clientSecret []byte, serverSecret []byte) (error, error) {
+	accepted := make(chan error, 1)
+	go func() {
+		m, err := accept(NewMessenger(server), serverSecret)
+		if err == nil {
+			var v int
+			err = m.Expect(Continue, &v)
+			if err == nil && v != 42 {
+				t.Errorf("received %d, sent 42", v)
+			}
+
+			// Read until the client closes so that TLS can deliver its closing alert over the pipe
+			m.Receive()
+		}
+		server.Close()
+		accepted <- err
+	}()
+
+	m := NewMessenger(client)
+	err := m.hello(clientSecret)
+	if err == nil {
+		err = m.Send(Continue, 42)
+	}
+	client.Close()
+	return err, <-accepted
+}
+
+func TestSharedSecret(t *testing.T) {
+	for _, codec := range []Codec{Gob, Float64} {
+		DefaultCodec = codec
+
+		client, server := net.Pipe()
+		clientErr, serverErr := handshake(t, client, server, []byte("secret"), []byte("secret"))
+		if clientErr != nil || serverErr != nil {
+			t.Fatalf("%s: matching secrets failed: %v, %v", codec, clientErr, serverErr)
+		}
+
+		client, server = net.Pipe()
+		clientErr, serverErr = handshake(t, client, server, nil, nil)
+		if clientErr != nil || serverErr != nil {
+			t.Fatalf("%s: no secrets failed: %v, %v", codec, clientErr, serverErr)
+		}
+	}
+	DefaultCodec = Gob
+
+	cases := []struct {
+		name           string
+		client, server []byte
+	}{
+		{"wrong secret", []byte("guess"), []byte("secret")},
+		{"client without secret", nil, []byte("secret")},
+		{"server without secret", []byte("secret"), nil},
+	}
+	for _, c := range cases {
+		client, server := net.Pipe()
+		clientErr, serverErr := handshake(t, client, server, c.client, c.server)
+		if !errors.Is(clientErr, ErrUnauthenticated) {
+			t.Errorf("%s: client got %v, expected %v", c.name, clientErr, ErrUnauthenticated)
+		}
+		if serverErr == nil {
+			t.Errorf("%s: server accepted the connection", c.name)
+		}
+	}
+}
+
+// certificates generates a set of certificates in a temporary directory and loads them
+func certificates(t *testing.T) (*tls.Config, *tls.Config, func()) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = GenerateCertificates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client, err := loadTLSConfigs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, client, func() { os.RemoveAll(dir) }
+}
+
+func TestMutualTLS(t *testing.T) {
+	server, client, cleanup := certificates(t)
+	defer cleanup()
+	otherServer, otherClient, otherCleanup := certificates(t)
+	defer otherCleanup()
+
+	c, s := net.Pipe()
+	clientErr, serverErr := handshake(t, tls.Client(c, client), tls.Server(s, server), []byte("secret"), []byte("secret"))
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("certificates from the same authority failed: %v, %v", clientErr, serverErr)
+	}
+
+	// A client or a server with a certificate from another authority is rejected by the other side
+	c, s = net.Pipe()
+	clientErr, serverErr = handshake(t, tls.Client(c, otherClient), tls.Server(s, server), nil, nil)
+	if clientErr == nil || serverErr == nil {
+		t.Errorf("client from another authority: %v, %v", clientErr, serverErr)
+	}
+
+	c, s = net.Pipe()
+	clientErr, serverErr = handshake(t, tls.Client(c, client), tls.Server(s, otherServer), nil, nil)
+	if clientErr == nil || serverErr == nil {
+		t.Errorf("server from another authority: %v, %v", clientErr, serverErr)
+	}
+}
+
+func TestListenOverTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = GenerateCertificates(dir)
+	if err == nil {
+		err = LoadTLS(dir)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetSecret([]byte("secret"))
+	defer func() {
+		security.server, security.client, security.secret = nil, nil, nil
+	}()
+
+	l, err := Listen(MemoryScheme + "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		m, err := Accept(conn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		env, err := m.Receive()
+		if err == nil {
+			err = m.Reply(env, "pong")
+		}
+		if err != nil {
+			t.Error(err)
+		}
+		m.Receive()
+	}()
+
+	m, err := Connect(MemoryScheme + "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	reply, err := m.Request(ModelRequest, "ping")
+	var s string
+	if err == nil {
+		err = reply.Decode(&s)
+	}
+	if err != nil || s != "pong" {
+		t.Fatal(s, err)
+	}
+	if _, ok := m.conn.(*tls.Conn); !ok {
+		t.Fatalf("connection is a %T, not TLS", m.conn)
+	}
+}
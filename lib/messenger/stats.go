@@ -0,0 +1,119 @@
+package messenger
+
+import (
+	"bufio"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Count is a struct that represents a number of messages and the bytes they took up on the wire
+type Count struct {
+	Messages int64
+	Bytes    int64
+}
+
+// Traffic is a struct that represents a snapshot of the messages sent and received, in total and by kind of message
+type Traffic struct {
+	Sent           Count
+	Received       Count
+	SentByKind     map[Kind]Count
+	ReceivedByKind map[Kind]Count
+}
+
+// Kinds returns every kind of message that was sent or received, in alphabetical order
+func (t Traffic) Kinds() []Kind {
+	var kinds []Kind
+	for kind := range t.SentByKind {
+		kinds = append(kinds, kind)
+	}
+	for kind := range t.ReceivedByKind {
+		if _, ok := t.SentByKind[kind]; !ok {
+			kinds = append(kinds, kind)
+		}
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i] < kinds[j] })
+	return kinds
+}
+
+// counter is a struct that holds a count which is updated atomically
+type counter struct {
+	messages int64
+	bytes    int64
+}
+
+func (c *counter) add(bytes int64) {
+	atomic.AddInt64(&c.messages, 1)
+	atomic.AddInt64(&c.bytes, bytes)
+}
+
+func (c *counter) load() Count {
+	return Count{atomic.LoadInt64(&c.messages), atomic.LoadInt64(&c.bytes)}
+}
+
+// traffic is a struct that holds the live counters behind a Traffic snapshot
+type traffic struct {
+	sent           counter
+	received       counter
+	sentByKind     sync.Map
+	receivedByKind sync.Map
+}
+
+func (t *traffic) recordSent(kind Kind, bytes int64) {
+	t.sent.add(bytes)
+	c, _ := t.sentByKind.LoadOrStore(kind, &counter{})
+	c.(*counter).add(bytes)
+}
+
+func (t *traffic) recordReceived(kind Kind, bytes int64) {
+	t.received.add(bytes)
+	c, _ := t.receivedByKind.LoadOrStore(kind, &counter{})
+	c.(*counter).add(bytes)
+}
+
+func (t *traffic) snapshot() Traffic {
+	s := Traffic{Sent: t.sent.load(), Received: t.received.load(), SentByKind: make(map[Kind]Count), ReceivedByKind: make(map[Kind]Count)}
+	t.sentByKind.Range(func(kind, c interface{}) bool {
+		s.SentByKind[kind.(Kind)] = c.(*counter).load()
+		return true
+	})
+	t.receivedByKind.Range(func(kind, c interface{}) bool {
+		s.ReceivedByKind[kind.(Kind)] = c.(*counter).load()
+		return true
+	})
+	return s
+}
+
+// total counts the traffic of every messenger in this process
+var total traffic
+
+// TotalTraffic returns the messages and bytes sent and received by every messenger in this process
+func TotalTraffic() Traffic {
+	return total.snapshot()
+}
+
+// Traffic returns the messages and bytes sent and received over this messenger's connection
+func (m *Messenger) Traffic() Traffic {
+	return m.state.traffic.snapshot()
+}
+
+// countingReader is a struct that counts the bytes read from a connection.
+// It implements io.ByteReader so that a gob decoder reads exactly one message at a time instead of buffering ahead
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.n++
+	}
+	return b, err
+}
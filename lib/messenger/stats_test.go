@@ -0,0 +1,109 @@
+package messenger
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// countingConn is a connection that counts the bytes written to it
+type countingConn struct {
+	net.Conn
+	written int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func TestTraffic(t *testing.T) {
+	client, server := net.Pipe()
+	conn := &countingConn{Conn: client}
+	c, s := NewMessenger(conn), NewMessenger(server)
+	defer c.Close()
+	defer s.Close()
+	before := TotalTraffic()
+	// The client sends a small update, one of at least 100 floats and a heartbeat, then a request the server replies to
+	// The client sends a small update and one much larger, even though the first carries gob's type definitions, and a heartbeat, then a request the server replies to
+	replied := make(chan error, 1)
+	go func() {
+		var err error
+		for i := 0; i < 2 && err == nil; i++ {
+			err = s.Expect(ParameterUpdate, new([]float64))
+		}
+		var request Envelope
+		if err == nil {
+			request, err = s.Receive()
+		}
+		if err == nil {
+			err = s.Reply(request, 1)
+		}
+		replied <- err
+	}()
+
+	err := c.Send(ParameterUpdate, []float64{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := c.Traffic().SentByKind[ParameterUpdate]
+	larger := make([]float64, 100)
+	for i := range larger {
+		larger[i] = float64(i) + 0.1
+	}
+	err = c.Send(ParameterUpdate, larger)
+	if err == nil {
+		err = c.Send(Heartbeat)
+	}
+	if err == nil {
+		_, err = c.Request(DataRequest)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-replied
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every byte the client wrote is counted once by each end, heartbeats included
+	sent, received := c.Traffic(), s.Traffic()
+	written := atomic.LoadInt64(&conn.written)
+	if sent.Sent != (Count{4, written}) || received.Received != sent.Sent {
+		t.Errorf("client counted %+v sent and server %+v received, %d bytes were written", sent.Sent, received.Received, written)
+	}
+	if sent.Received != received.Sent || sent.Received.Messages != 1 || sent.Received.Bytes == 0 {
+		t.Errorf("server counted %+v sent and client %+v received", received.Sent, sent.Received)
+	}
+
+	updates := sent.SentByKind[ParameterUpdate]
+	if updates.Messages != 2 || first.Messages != 1 || updates.Bytes-first.Bytes <= 100*8 || received.ReceivedByKind[ParameterUpdate] != updates {
+		t.Errorf("updates were counted as %+v sent after the first was %+v, and %+v received", updates, first, received.ReceivedByKind[ParameterUpdate])
+	}
+	var sum int64
+	for _, kind := range sent.Kinds() {
+		sum += sent.SentByKind[kind].Bytes
+		if sent.SentByKind[kind] != received.ReceivedByKind[kind] {
+			t.Errorf("%s was counted as %+v sent and %+v received", kind, sent.SentByKind[kind], received.ReceivedByKind[kind])
+		}
+	}
+	if sum != written || sent.SentByKind[Heartbeat].Messages != 1 || sent.SentByKind[DataRequest].Messages != 1 {
+		t.Errorf("client counted %v by kind, %d bytes were written", sent.SentByKind, written)
+	}
+	if kinds := received.Kinds(); len(kinds) != 4 {
+		t.Errorf("server counted kinds %v", kinds)
+	}
+
+	// The process total counts both ends of the pipe, heartbeats are left out as other tests may still be sending them
+	after := TotalTraffic()
+	for _, kind := range []Kind{ParameterUpdate, DataRequest, Reply} {
+		ours := sent.SentByKind[kind].Bytes + received.SentByKind[kind].Bytes
+		if counted := after.SentByKind[kind].Bytes - before.SentByKind[kind].Bytes; counted != ours {
+			t.Errorf("process total counted %d more bytes of %s sent, expected %d", counted, kind, ours)
+		}
+		if counted := after.ReceivedByKind[kind].Bytes - before.ReceivedByKind[kind].Bytes; counted != ours {
+			t.Errorf("process total counted %d more bytes of %s received, expected %d", counted, kind, ours)
+		}
+	}
+}
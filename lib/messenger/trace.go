@@ -0,0 +1,116 @@
+package messenger
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Directions of a traced envelope
+const (
+	DirectionSent     = "tx"
+	DirectionReceived = "rx"
+)
+
+// TraceEvent is a struct that represents one envelope sent or received by this process, written as a line of a JSONL trace.
+// Conn identifies the connection within the process, Peer is the address dialed or the remote address of an accepted connection
+// and Local is the local address of the connection, which for an accepted connection is the address listened on
+type TraceEvent struct {
+	Time      time.Time `json:"time"`
+	Conn      uint64    `json:"conn"`
+	Peer      string    `json:"peer"`
+	Local     string    `json:"local"`
+	Direction string    `json:"direction"`
+	Kind      Kind      `json:"kind"`
+	Seq       uint64    `json:"seq"`
+	RequestID uint64    `json:"request,omitempty"`
+	Size      int64     `json:"size"`
+	Payload   []byte    `json:"payload,omitempty"`
+}
+
+// Envelope returns the envelope a traced event carried, the payload is only present if it was recorded
+func (e TraceEvent) Envelope() Envelope {
+	return Envelope{e.Kind, e.Seq, e.RequestID, e.Payload}
+}
+
+// tracer holds where envelopes are traced to. enabled is set while enc is, so that messengers need not lock when tracing is off
+var tracer = struct {
+	sync.Mutex
+	enabled  int32
+	enc      *json.Encoder
+	payloads bool
+}{}
+
+// connections numbers the messengers created in this process so that a trace can tell their envelopes apart
+var connections uint64
+
+// StartTracing records every envelope sent and received by every messenger to w, one JSON object per line.
+// Payloads are only recorded if asked for, as a replay needs them but they make the trace as large as the traffic
+func StartTracing(w io.Writer, payloads bool) {
+	tracer.Lock()
+	tracer.enc = json.NewEncoder(w)
+	tracer.payloads = payloads
+	atomic.StoreInt32(&tracer.enabled, 1)
+	tracer.Unlock()
+}
+
+// StopTracing stops recording envelopes
+func StopTracing() {
+	tracer.Lock()
+	tracer.enc = nil
+	atomic.StoreInt32(&tracer.enabled, 0)
+	tracer.Unlock()
+}
+
+// traceEnvelope records an envelope if tracing has been started
+func (m *Messenger) traceEnvelope(direction string, env Envelope, size int64) {
+	if atomic.LoadInt32(&tracer.enabled) == 0 {
+		return
+	}
+
+	tracer.Lock()
+	defer tracer.Unlock()
+	if tracer.enc == nil {
+		return
+	}
+
+	event := TraceEvent{time.Now(), m.state.id, m.state.peer, m.state.local, direction, env.Kind, env.Seq, env.RequestID, size, nil}
+	if tracer.payloads {
+		event.Payload = env.Payload
+	}
+	tracer.enc.Encode(&event)
+}
+
+// ReadTrace reads every event of a trace written by StartTracing
+func ReadTrace(r io.Reader) ([]TraceEvent, error) {
+	var events []TraceEvent
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var event TraceEvent
+		err := dec.Decode(&event)
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return events, err
+		}
+		events = append(events, event)
+	}
+}
+
+// Forward sends the kind and payload of an envelope recorded elsewhere, numbered for this connection.
+// If the envelope was a request, the ID to await its reply with is returned. A reply keeps the RequestID it is given
+func (m *Messenger) Forward(env Envelope) (uint64, error) {
+	request := env.RequestID != 0 && env.RequestID == env.Seq
+	if request {
+		env.RequestID = 0
+	}
+	return m.sendPayload(env.Kind, request, env.RequestID, env.Payload)
+}
+
+func nextConnection() uint64 {
+	return atomic.AddUint64(&connections, 1)
+}
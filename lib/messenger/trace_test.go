@@ -0,0 +1,90 @@
+package messenger
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// exchange sends a request from a client messenger to a server messenger over a pipe and replies to it
+func exchange(t *testing.T) {
+	client, server := net.Pipe()
+	c, s := NewMessenger(client), NewMessenger(server)
+	defer c.Close()
+	defer s.Close()
+
+	replied := make(chan error, 1)
+	go func() {
+		request, err := s.Receive()
+		if err == nil {
+			err = s.Reply(request, 2)
+		}
+		replied <- err
+	}()
+
+	reply, err := c.Request(DataRequest, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-replied
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var v int
+	err = reply.Decode(&v)
+	if err != nil || v != 2 {
+		t.Fatalf("reply decoded to %d with error %v", v, err)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	for _, payloads := range []bool{false, true} {
+		var buffer bytes.Buffer
+		StartTracing(&buffer, payloads)
+		exchange(t)
+		StopTracing()
+
+		events, err := ReadTrace(&buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Both ends of the pipe are traced, each sending one envelope and receiving the other's
+		expected := []struct {
+			direction string
+			kind      Kind
+		}{{DirectionSent, DataRequest}, {DirectionReceived, DataRequest}, {DirectionSent, Reply}, {DirectionReceived, Reply}}
+		if len(events) != len(expected) {
+			t.Fatalf("traced %d events, expected %d: %v", len(events), len(expected), events)
+		}
+		for i, event := range events {
+			if event.Direction != expected[i].direction || event.Kind != expected[i].kind {
+				t.Errorf("event %d was %s %s, expected %s %s", i, event.Direction, event.Kind, expected[i].direction, expected[i].kind)
+			}
+			if event.Seq != 1 || event.RequestID != 1 || event.Size == 0 {
+				t.Errorf("event %d was numbered %d for request %d with size %d", i, event.Seq, event.RequestID, event.Size)
+			}
+			if (event.Payload != nil) != payloads {
+				t.Errorf("event %d had payload %v when payloads were traced %t", i, event.Payload, payloads)
+			}
+		}
+		if events[0].Conn != events[3].Conn || events[1].Conn != events[2].Conn || events[0].Conn == events[1].Conn {
+			t.Errorf("events were traced on connections %d, %d, %d and %d", events[0].Conn, events[1].Conn, events[2].Conn, events[3].Conn)
+		}
+		if payloads && !bytes.Equal(events[0].Payload, events[1].Payload) {
+			t.Errorf("request was sent with payload %v and received with %v", events[0].Payload, events[1].Payload)
+		}
+	}
+}
+
+func TestTraceStopped(t *testing.T) {
+	var buffer bytes.Buffer
+	StartTracing(&buffer, true)
+	StopTracing()
+	exchange(t)
+
+	if buffer.Len() != 0 {
+		t.Errorf("traced %q after tracing stopped", buffer.String())
+	}
+}
@@ -0,0 +1,206 @@
+package messenger
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Transport is the interface for a network that messengers listen and connect on
+type Transport interface {
+	Listen(address string) (net.Listener, error)
+	Dial(address string) (net.Conn, error)
+}
+
+// MemoryScheme prefixes the addresses of the in-memory transport, e.g. "mem://parameter"
+const MemoryScheme = "mem://"
+
+// UnixScheme prefixes the addresses of Unix domain sockets, e.g. "unix:///tmp/parameter.sock"
+const UnixScheme = "unix://"
+
+// TCP is the transport of IPv4 TCP connections, used for any address without a scheme
+var TCP Transport = tcpTransport{}
+
+// Unix is the transport of Unix domain sockets, for nodes running on the same machine
+var Unix Transport = unixTransport{}
+
+// Memory is the transport of in-memory connections between nodes running in the same process
+var Memory Transport = &memoryTransport{listeners: make(map[string]*memoryListener)}
+
+// transportFor returns the transport an address belongs to and the address with its scheme removed
+func transportFor(address string) (Transport, string) {
+	if strings.HasPrefix(address, MemoryScheme) {
+		return Memory, strings.TrimPrefix(address, MemoryScheme)
+	}
+	if strings.HasPrefix(address, UnixScheme) {
+		return Unix, strings.TrimPrefix(address, UnixScheme)
+	}
+	return TCP, address
+}
+
+// Listen listens for connections on an address of any transport, accepting them over TLS if it has been enabled
+func Listen(address string) (net.Listener, error) {
+	transport, address := transportFor(address)
+	l, err := transport.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	return secureListener(l), nil
+}
+
+// dial opens a connection to an address of any transport, over TLS if it has been enabled
+func dial(address string) (net.Conn, error) {
+	transport, address := transportFor(address)
+	conn, err := transport.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	return secureConn(conn), nil
+}
+
+type tcpTransport struct{}
+
+func (tcpTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp4", address)
+}
+
+func (tcpTransport) Dial(address string) (net.Conn, error) {
+	return net.Dial("tcp4", address)
+}
+
+type unixTransport struct{}
+
+// Listen listens on a socket file, replacing one left behind by a process that exited without closing its listener
+func (unixTransport) Listen(path string) (net.Listener, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil && staleSocket(path) {
+		os.Remove(path)
+		l, err = net.Listen("unix", path)
+	}
+	return l, err
+}
+
+func (unixTransport) Dial(path string) (net.Conn, error) {
+	return net.Dial("unix", path)
+}
+
+// staleSocket returns whether a path is a socket file that nothing is listening on
+func staleSocket(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return false
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return true
+	}
+	conn.Close()
+	return false
+}
+
+// errConnectionRefused is returned when dialling an in-memory address that nothing is listening on
+var errConnectionRefused = errors.New("connection refused")
+
+// errListenerClosed is returned when accepting on an in-memory listener that has been closed
+var errListenerClosed = errors.New("use of closed listener")
+
+// memoryTransport is a struct that represents the in-memory listeners of this process, connections are pairs of net.Pipe ends
+type memoryTransport struct {
+	// dialed is first so that it is aligned for atomic operations
+	dialed    uint64
+	mutex     sync.Mutex
+	listeners map[string]*memoryListener
+}
+
+func (t *memoryTransport) Listen(address string) (net.Listener, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.listeners[address]; ok {
+		return nil, fmt.Errorf("listen %s%s: address already in use", MemoryScheme, address)
+	}
+
+	l := &memoryListener{transport: t, address: memoryAddr(address), conns: make(chan net.Conn), closed: make(chan bool)}
+	t.listeners[address] = l
+	return l, nil
+}
+
+func (t *memoryTransport) Dial(address string) (net.Conn, error) {
+	t.mutex.Lock()
+	l, ok := t.listeners[address]
+	t.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("dial %s%s: %w", MemoryScheme, address, errConnectionRefused)
+	}
+
+	// Each connection is named like an ephemeral port so that traces can tell the dialing ends apart
+	name := memoryAddr(fmt.Sprintf("%s#%d", address, atomic.AddUint64(&t.dialed, 1)))
+	client, server := net.Pipe()
+	select {
+	case l.conns <- memoryConn{server, l.address, name}:
+		return memoryConn{client, name, l.address}, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("dial %s%s: %w", MemoryScheme, address, errConnectionRefused)
+	}
+}
+
+// memoryListener is a struct that represents an in-memory address being listened on
+type memoryListener struct {
+	transport *memoryTransport
+	address   memoryAddr
+	conns     chan net.Conn
+	closed    chan bool
+	once      sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("accept %s%s: %w", MemoryScheme, l.address, errListenerClosed)
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.once.Do(func() {
+		l.transport.mutex.Lock()
+		delete(l.transport.listeners, string(l.address))
+		l.transport.mutex.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.address
+}
+
+// memoryConn is a struct that represents one end of an in-memory connection, addressed by the listener's name and the dialer's
+type memoryConn struct {
+	net.Conn
+	local  memoryAddr
+	remote memoryAddr
+}
+
+func (c memoryConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c memoryConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// memoryAddr is the name an in-memory listener is known by
+type memoryAddr string
+
+func (a memoryAddr) Network() string {
+	return "mem"
+}
+
+func (a memoryAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,134 @@
+package messenger
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// socketDir creates a directory for socket files, removing it when the returned function is called
+func socketDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "messenger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+// greet accepts one connection on l and replies to the join request the peer sends with the name it carried
+func greet(l net.Listener) <-chan error {
+	greeted := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			greeted <- err
+			return
+		}
+		msg, err := Accept(conn)
+		if err != nil {
+			greeted <- err
+			return
+		}
+		defer msg.Close()
+		request, err := msg.Receive()
+		if err == nil {
+			var name string
+			err = request.Decode(&name)
+			if err == nil {
+				err = msg.Reply(request, name)
+			}
+		}
+		greeted <- err
+	}()
+	return greeted
+}
+
+// join connects to address and checks that the server greets it by name
+func join(t *testing.T, address string) {
+	msg, err := Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer msg.Close()
+	reply, err := msg.Request(Join, "unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	err = reply.Decode(&name)
+	if err != nil || name != "unix" {
+		t.Errorf("server replied %q with error %v", name, err)
+	}
+}
+
+func TestUnixTransport(t *testing.T) {
+	dir, remove := socketDir(t)
+	defer remove()
+	address := UnixScheme + filepath.Join(dir, "ps.sock")
+
+	l, err := Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	greeted := greet(l)
+	join(t, address)
+	err = <-greeted
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A socket something is still listening on is not taken over
+	other, err := Listen(address)
+	if err == nil {
+		other.Close()
+		t.Error("listened on a socket already in use")
+	}
+}
+
+func TestStaleSocket(t *testing.T) {
+	dir, remove := socketDir(t)
+	defer remove()
+	path := filepath.Join(dir, "ps.sock")
+
+	// A listener that is not unlinked on closing leaves its socket file behind, as a process that exits does
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	if _, err = os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := Listen(UnixScheme + path)
+	if err != nil {
+		t.Fatalf("could not listen in place of a stale socket: %v", err)
+	}
+	defer l.Close()
+	greeted := greet(l)
+	join(t, UnixScheme+path)
+	err = <-greeted
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A file that is not a socket is left alone
+	file := filepath.Join(dir, "file")
+	err = ioutil.WriteFile(file, []byte("data"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err := Listen(UnixScheme + file); err == nil {
+		l.Close()
+		t.Error("listened in place of a file that is not a socket")
+	}
+	if data, err := ioutil.ReadFile(file); err != nil || string(data) != "data" {
+		t.Errorf("file that is not a socket became %q with error %v", data, err)
+	}
+}
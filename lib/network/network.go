@@ -3,6 +3,7 @@ package network
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"gonum.org/v1/gonum/mat"
 	"gonum.org/v1/gonum/stat/distuv"
@@ -25,12 +26,24 @@ type LayerConfig struct {
 type Network struct {
 	Config NetworkConfig
 	layers []layer
-	mutex  sync.Mutex
+
+	// current holds the published parameters, which are replaced rather than changed so that reading them never waits for an update.
+	// mutex is held while publishing, after the mutex of each layer being updated
+	current atomic.Value
+	mutex   sync.Mutex
+}
+
+// parameters is a struct that holds the weights and biases of every layer of a network. Once published it is never changed
+type parameters struct {
+	weights []*mat.Dense
+	biases  []*mat.VecDense
 }
 
 // NewNetwork creates a new neural network
 func NewNetwork() *Network {
-	return &Network{Config: NetworkConfig{LearningRate: 0.01}}
+	nn := &Network{Config: NetworkConfig{LearningRate: 0.01}}
+	nn.current.Store(parameters{})
+	return nn
 }
 
 // NewNetworkFromConfig creates a new neural network using a supplied config
@@ -46,8 +59,12 @@ func NewNetworkFromConfig(config NetworkConfig) *Network {
 // WithLayer is a chain method for building a network and its config
 func (nn *Network) WithLayer(in int, out int, activation string) *Network {
 	layerConfig := LayerConfig{in, out, activation}
-	nn.layers = append(nn.layers, newLayerFromConfig(layerConfig))
+	layer, weights, biases := newLayerFromConfig(layerConfig)
+	nn.layers = append(nn.layers, layer)
 	nn.Config.LayerConfigs = append(nn.Config.LayerConfigs, layerConfig)
+
+	params := nn.parameters()
+	nn.current.Store(parameters{append(params.weights, weights), append(params.biases, biases)})
 	return nn
 }
 
@@ -57,50 +74,93 @@ func (nn *Network) WithLearningRate(eta float64) *Network {
 	return nn
 }
 
-// SetParameters overrides the parameters of each layer in this neural network
-func (nn *Network) SetParameters(weights []mat.Dense, biases []mat.VecDense) {
+// parameters returns the parameters last published, which must not be changed
+func (nn *Network) parameters() parameters {
+	return nn.current.Load().(parameters)
+}
+
+// lockLayers takes the mutex of every layer, so that no update is applied until unlockLayers is called
+func (nn *Network) lockLayers() {
+	for i := 0; i < len(nn.layers); i++ {
+		nn.layers[i].mutex.Lock()
+	}
+}
+
+func (nn *Network) unlockLayers() {
+	for i := 0; i < len(nn.layers); i++ {
+		nn.layers[i].mutex.Unlock()
+	}
+}
+
+// publish replaces the parameters of the layers given, the mutex of each of those layers must be held
+func (nn *Network) publish(layers []int, weights []*mat.Dense, biases []*mat.VecDense) {
 	nn.mutex.Lock()
+	params := nn.parameters()
+	next := parameters{append([]*mat.Dense(nil), params.weights...), append([]*mat.VecDense(nil), params.biases...)}
+	for i, j := range layers {
+		next.weights[j] = weights[i]
+		next.biases[j] = biases[i]
+	}
+	nn.current.Store(next)
+	nn.mutex.Unlock()
+}
+
+// SetParameters overrides the parameters of each layer in this neural network, which takes ownership of the supplied parameters
+func (nn *Network) SetParameters(weights []mat.Dense, biases []mat.VecDense) {
 	if len(weights) != len(nn.layers) || len(biases) != len(nn.layers) {
 		fmt.Println("Error setting network weights. Not enough weight matrices supplied.")
 		return
 	}
 
+	layers := make([]int, len(nn.layers))
+	w := make([]*mat.Dense, len(nn.layers))
+	b := make([]*mat.VecDense, len(nn.layers))
 	for i := 0; i < len(nn.layers); i++ {
-		nn.layers[i].weights = &weights[i]
-		nn.layers[i].biases = &biases[i]
+		layers[i] = i
+		w[i] = &weights[i]
+		b[i] = &biases[i]
 	}
-	nn.mutex.Unlock()
+
+	nn.lockLayers()
+	nn.publish(layers, w, b)
+	nn.unlockLayers()
 }
 
-// Parameters returns the parameters for each layer of this neural network
+// Parameters returns a copy of the parameters for each layer of this neural network. It never waits for an update to be applied
 func (nn *Network) Parameters() ([]mat.Dense, []mat.VecDense) {
-	nn.mutex.Lock()
+	params := nn.parameters()
 
 	var weights []mat.Dense
 	var biases []mat.VecDense
 
 	for i := 0; i < len(nn.layers); i++ {
 		var w mat.Dense
-		w.CloneFrom(nn.layers[i].weights)
+		w.CloneFrom(params.weights[i])
 
 		var b mat.VecDense
-		b.CloneVec(nn.layers[i].biases)
+		b.CloneVec(params.biases[i])
 
 		weights = append(weights, w)
 		biases = append(biases, b)
 	}
 
-	nn.mutex.Unlock()
-
 	return weights, biases
 }
 
+// Clone returns a new neural network with the same config and a copy of this network's parameters
+func (nn *Network) Clone() *Network {
+	clone := NewNetworkFromConfig(nn.Config)
+	clone.SetParameters(nn.Parameters())
+	return clone
+}
+
 // ZeroedParameters returns parameter matrices and vectors of the correct dimensions but filled with zero
 func (nn *Network) ZeroedParameters() ([]mat.Dense, []mat.VecDense) {
-	weights, biases := nn.Parameters()
-	for i := 0; i < len(weights); i++ {
-		weights[i].Zero()
-		biases[i].Zero()
+	var weights []mat.Dense
+	var biases []mat.VecDense
+	for i := 0; i < len(nn.layers); i++ {
+		weights = append(weights, *mat.NewDense(nn.layers[i].out, nn.layers[i].in, nil))
+		biases = append(biases, *mat.NewVecDense(nn.layers[i].out, nil))
 	}
 
 	return weights, biases
@@ -112,33 +172,62 @@ func (nn *Network) outputLayer() *layer {
 
 // Predict feeds an input forward through the network and returns its output
 func (nn *Network) Predict(input *mat.VecDense) *mat.VecDense {
-	nn.layers[0].feed(input)
+	return nn.predict(nn.parameters(), input)
+}
+
+// predict feeds an input forward through the network with the supplied parameters
+func (nn *Network) predict(params parameters, input *mat.VecDense) *mat.VecDense {
+	nn.layers[0].feed(input, params.weights[0], params.biases[0])
 	for j := 1; j < len(nn.layers); j++ {
-		nn.layers[j].feed(nn.layers[j-1].output)
+		nn.layers[j].feed(nn.layers[j-1].output, params.weights[j], params.biases[j])
 	}
 	return nn.outputLayer().output
 }
 
-// UpdateWithDeltas shifts all the parameters by the supplied amounts scaled by the learning rate
+// UpdateWithDeltas shifts all the parameters by the supplied amounts scaled by the learning rate.
+// The updated layers are published together, so no reader sees the update applied to only some of them
 func (nn *Network) UpdateWithDeltas(weightDeltas []mat.Dense, biasDeltas []mat.VecDense) {
-	nn.mutex.Lock()
+	layers := make([]int, len(nn.layers))
+	weights := make([]*mat.Dense, len(nn.layers))
+	biases := make([]*mat.VecDense, len(nn.layers))
+
+	nn.lockLayers()
+	params := nn.parameters()
 	// Update each layers weights with deltas
 	for j := 0; j < len(nn.layers); j++ {
-		layer := nn.layers[j]
+		layers[j] = j
+		weights[j], biases[j] = updated(params.weights[j], params.biases[j], &weightDeltas[j], &biasDeltas[j], nn.Config.LearningRate)
+	}
+	nn.publish(layers, weights, biases)
+	nn.unlockLayers()
+}
 
-		var w mat.Dense
-		w.CloneFrom(&weightDeltas[j])
+// Layers returns the number of layers in this neural network
+func (nn *Network) Layers() int {
+	return len(nn.layers)
+}
 
-		var b mat.VecDense
-		b.CloneVec(&biasDeltas[j])
+// LayerParameters returns a copy of the parameters of a single layer. It never waits for an update to be applied
+func (nn *Network) LayerParameters(j int) (mat.Dense, mat.VecDense) {
+	params := nn.parameters()
 
-		w.Scale(nn.Config.LearningRate, &w)
-		b.ScaleVec(nn.Config.LearningRate, &b)
+	var w mat.Dense
+	w.CloneFrom(params.weights[j])
 
-		layer.weights.Sub(layer.weights, &w)
-		layer.biases.SubVec(layer.biases, &b)
-	}
-	nn.mutex.Unlock()
+	var b mat.VecDense
+	b.CloneVec(params.biases[j])
+	return w, b
+}
+
+// UpdateLayerWithDeltas shifts the parameters of a single layer by the supplied amounts scaled by the learning rate.
+// Only this layer is locked, so updates to different layers are applied concurrently
+func (nn *Network) UpdateLayerWithDeltas(j int, weightDeltas *mat.Dense, biasDeltas *mat.VecDense) {
+	mutex := nn.layers[j].mutex
+	mutex.Lock()
+	params := nn.parameters()
+	w, b := updated(params.weights[j], params.biases[j], weightDeltas, biasDeltas, nn.Config.LearningRate)
+	nn.publish([]int{j}, []*mat.Dense{w}, []*mat.VecDense{b})
+	mutex.Unlock()
 }
 
 // Train returns the gradients that this network should be updated with based on the supplied list of training data records
@@ -152,11 +241,14 @@ func (nn *Network) Train(trainData []Record) ([]mat.Dense, []mat.VecDense) {
 		biasDeltas = append(biasDeltas, *mat.NewVecDense(nn.layers[j].out, nil))
 	}
 
+	// Every record is trained on the same parameters, whatever is published meanwhile
+	params := nn.parameters()
+
 	for r := 0; r < len(trainData); r++ {
 		record := trainData[r]
 
 		// Forward propagation
-		prediction := nn.Predict(&record.Data)
+		prediction := nn.predict(params, &record.Data)
 
 		// Get target prediction
 		target := record.Expected
@@ -213,7 +305,7 @@ func (nn *Network) Train(trainData []Record) ([]mat.Dense, []mat.VecDense) {
 					for m := 0; m < nextLayer.out; m++ {
 
 						// Retrieve saved value and multiply by weight to backpropagate the error
-						dEdO += dEdI.AtVec(m) * nextLayer.weights.At(m, k)
+						dEdO += dEdI.AtVec(m) * params.weights[j+1].At(m, k)
 					}
 
 					// rest is the same
@@ -375,36 +467,46 @@ func (nn *Network) GradientCheck(record Record, eps float64) (float64, float64)
 	return weightSum / float64(weightCount), biasSum / float64(biasCount)
 }
 
-// layer is a struct that represents a single layer of the neural network
+// layer is a struct that represents a single layer of the neural network, its parameters are held by the network
 type layer struct {
 	in                 int
 	out                int
 	activationFunction string
-	weights            *mat.Dense
-	biases             *mat.VecDense
 	activation         *mat.VecDense
 	output             *mat.VecDense
+
+	// mutex is held while updating the parameters of this layer alone, so that updates to different layers need not wait for each other
+	mutex *sync.Mutex
 }
 
-func newLayer(in int, out int, activationFunction string) layer {
+func newLayer(in int, out int, activationFunction string) (layer, *mat.Dense, *mat.VecDense) {
 	weights := initialiseWeights(out, in)
 	biases := mat.NewVecDense(out, nil)
-	for i := 0; i < out; i++ {
-		biases.SetVec(i, 1.0)
-	}
 	activation := mat.NewVecDense(out, nil)
 	output := mat.NewVecDense(out, nil)
-	return layer{in, out, activationFunction, weights, activation, output, biases}
+	return layer{in, out, activationFunction, activation, output, &sync.Mutex{}}, weights, biases
 }
 
-func newLayerFromConfig(config LayerConfig) layer {
+func newLayerFromConfig(config LayerConfig) (layer, *mat.Dense, *mat.VecDense) {
 	return newLayer(config.In, config.Out, config.Activation)
 }
 
-func (layer *layer) feed(input *mat.VecDense) {
+// updated returns new parameters equal to the supplied ones shifted by the deltas scaled by eta, leaving the supplied ones unchanged
+func updated(weights *mat.Dense, biases *mat.VecDense, weightDeltas *mat.Dense, biasDeltas *mat.VecDense, eta float64) (*mat.Dense, *mat.VecDense) {
+	var w mat.Dense
+	w.Scale(eta, weightDeltas)
+	w.Sub(weights, &w)
+
+	var b mat.VecDense
+	b.ScaleVec(eta, biasDeltas)
+	b.SubVec(biases, &b)
+	return &w, &b
+}
+
+func (layer *layer) feed(input *mat.VecDense, weights *mat.Dense, biases *mat.VecDense) {
 	activation := mat.NewVecDense(layer.out, nil)
-	activation.MulVec(layer.weights, input)
-	activation.AddVec(activation, layer.biases)
+	activation.MulVec(weights, input)
+	activation.AddVec(activation, biases)
 	layer.activation = activation
 
 	if layer.activationFunction == "sigmoid" {
@@ -136,3 +136,34 @@ func Norm(vec *mat.VecDense) float64 {
 	}
 	return math.Sqrt(sum)
 }
+
+// FlattenParameters concatenates the weights and biases of every layer into a single slice
+func FlattenParameters(weights []mat.Dense, biases []mat.VecDense) []float64 {
+	var flat []float64
+	for i := 0; i < len(weights); i++ {
+		r, c := weights[i].Dims()
+		for j := 0; j < r; j++ {
+			flat = append(flat, weights[i].RawRowView(j)[:c]...)
+		}
+		for j := 0; j < biases[i].Len(); j++ {
+			flat = append(flat, biases[i].AtVec(j))
+		}
+	}
+	return flat
+}
+
+// UnflattenParameters copies a slice produced by FlattenParameters back into weight and bias matrices of the correct dimensions
+func UnflattenParameters(flat []float64, weights []mat.Dense, biases []mat.VecDense) {
+	idx := 0
+	for i := 0; i < len(weights); i++ {
+		r, c := weights[i].Dims()
+		for j := 0; j < r; j++ {
+			copy(weights[i].RawRowView(j)[:c], flat[idx:idx+c])
+			idx += c
+		}
+		for j := 0; j < biases[i].Len(); j++ {
+			biases[i].SetVec(j, flat[idx])
+			idx++
+		}
+	}
+}
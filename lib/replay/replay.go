@@ -0,0 +1,182 @@
+package replay
+
+import (
+	"bytes"
+	"comp3200/lib/messenger"
+	"fmt"
+	"log"
+)
+
+// Report is a struct that represents the outcome of a replay
+type Report struct {
+	Connections int
+	Sent        int
+	Received    int
+
+	// Differing counts replies whose payload was not the one recorded, which is expected unless the server starts from the recorded state
+	Differing int
+}
+
+// connection is a struct that represents a recorded connection being replayed
+type connection struct {
+	msg messenger.Messenger
+
+	// skipped holds the requests of the handshake, which Connect repeats itself, so that their replies are skipped too
+	skipped map[uint64]bool
+
+	// requests maps the IDs of recorded requests to the IDs of the same requests in the replay, in both directions
+	sent     map[uint64]uint64
+	received map[uint64]uint64
+}
+
+// ParameterConnections returns the connections in a trace that were made to parameter servers, in the order they were made
+func ParameterConnections(events []messenger.TraceEvent) []uint64 {
+	var conns []uint64
+	seen := make(map[uint64]bool)
+	for _, event := range events {
+		if event.Direction != messenger.DirectionSent || seen[event.Conn] {
+			continue
+		}
+		switch event.Kind {
+		case messenger.Hello, messenger.Authenticate, messenger.Heartbeat:
+			continue
+		case messenger.ModelRequest:
+			conns = append(conns, event.Conn)
+		}
+		seen[event.Conn] = true
+	}
+	return conns
+}
+
+// Replay re-drives servers with the messages a node sent on some of the connections in its trace, which must include payloads.
+// Every recorded peer of those connections is replaced by the next of addresses in the order peers were first connected to.
+// Messages are sent in the recorded order, and wherever the node received a message the replay waits for the same kind of
+// message, so a server sees the same sequence every time. The replay stops at the first message that differs in kind
+func Replay(events []messenger.TraceEvent, conns []uint64, addresses []string) (Report, error) {
+	var report Report
+	replayed := make(map[uint64]bool)
+	for _, conn := range conns {
+		replayed[conn] = true
+	}
+	if !hasPayloads(events, replayed) {
+		return report, fmt.Errorf("trace has no payloads, record it with -tracePayloads")
+	}
+
+	peers := make(map[string]string)
+	open := make(map[uint64]*connection)
+	defer func() {
+		for _, c := range open {
+			c.msg.Close()
+		}
+	}()
+
+	for i, event := range events {
+		if !replayed[event.Conn] || event.Kind == messenger.Heartbeat {
+			continue
+		}
+
+		c, ok := open[event.Conn]
+		if !ok {
+			address, ok := peers[event.Peer]
+			if !ok {
+				if len(peers) == len(addresses) {
+					return report, fmt.Errorf("trace connects to more than the %d addresses given", len(addresses))
+				}
+				address = addresses[len(peers)]
+				peers[event.Peer] = address
+			}
+
+			msg, err := messenger.Connect(address)
+			if err != nil {
+				return report, err
+			}
+			log.Println("Replaying connection", event.Conn, "to", event.Peer, "on", address)
+			c = &connection{msg: msg, skipped: make(map[uint64]bool), sent: make(map[uint64]uint64), received: make(map[uint64]uint64)}
+			open[event.Conn] = c
+			report.Connections++
+		}
+
+		var err error
+		if event.Direction == messenger.DirectionSent {
+			err = c.send(event)
+			if err == nil {
+				report.Sent++
+			}
+		} else {
+			var same bool
+			same, err = c.receive(event)
+			if err == nil {
+				report.Received++
+				if !same {
+					report.Differing++
+				}
+			}
+		}
+		if err != nil {
+			return report, fmt.Errorf("replay diverged at event %d (%s %s on connection %d): %w", i+1, event.Direction, event.Kind, event.Conn, err)
+		}
+	}
+	return report, nil
+}
+
+// hasPayloads returns whether the payloads of the replayed connections were recorded. Messages without a payload, such as a
+// leave request, look the same either way, so a trace has payloads if any message sent after a handshake has one
+func hasPayloads(events []messenger.TraceEvent, replayed map[uint64]bool) bool {
+	for _, event := range events {
+		if replayed[event.Conn] && event.Direction == messenger.DirectionSent && event.Payload != nil &&
+			event.Kind != messenger.Hello && event.Kind != messenger.Authenticate {
+			return true
+		}
+	}
+	return false
+}
+
+// send sends a recorded message again, the handshake having already been performed by Connect
+func (c *connection) send(event messenger.TraceEvent) error {
+	if event.Kind == messenger.Hello || event.Kind == messenger.Authenticate {
+		c.skipped[event.RequestID] = true
+		return nil
+	}
+
+	env := event.Envelope()
+	if env.Kind == messenger.Reply {
+		id, ok := c.received[env.RequestID]
+		if !ok {
+			return fmt.Errorf("reply to request %d that was not received", env.RequestID)
+		}
+		env.RequestID = id
+	}
+
+	id, err := c.msg.Forward(env)
+	if err != nil {
+		return err
+	}
+	if env.Kind != messenger.Reply && event.RequestID == event.Seq && event.RequestID != 0 {
+		c.sent[event.RequestID] = id
+	}
+	return nil
+}
+
+// receive waits for the message that was received at this point in the trace and returns whether its payload was the one recorded
+func (c *connection) receive(event messenger.TraceEvent) (bool, error) {
+	if event.Kind == messenger.Reply && c.skipped[event.RequestID] {
+		return true, nil
+	}
+
+	env, err := c.msg.Receive()
+	if err != nil {
+		return false, err
+	}
+	if env.Kind != event.Kind {
+		return false, fmt.Errorf("expected %s, %w", event.Kind, messenger.Unexpected(env))
+	}
+
+	if env.Kind == messenger.Reply {
+		if env.RequestID != c.sent[event.RequestID] {
+			return false, fmt.Errorf("expected reply to request %d, %w", c.sent[event.RequestID], messenger.Unexpected(env))
+		}
+	} else if env.RequestID != 0 {
+		c.received[event.RequestID] = env.RequestID
+	}
+	return event.Payload == nil || bytes.Equal(env.Payload, event.Payload), nil
+}
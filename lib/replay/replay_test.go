@@ -0,0 +1,142 @@
+package replay
+
+import (
+	"bytes"
+	"comp3200/lib/messenger"
+	"testing"
+)
+
+// serve accepts one connection on address and replies to each request with offset added to the number it carries,
+// returning every envelope received once the connection closes
+func serve(t *testing.T, address string, offset int) <-chan []messenger.Envelope {
+	l, err := messenger.Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan []messenger.Envelope, 1)
+	go func() {
+		defer l.Close()
+		var envs []messenger.Envelope
+		defer func() {
+			received <- envs
+		}()
+
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		msg, err := messenger.Accept(conn)
+		if err != nil {
+			return
+		}
+		defer msg.Close()
+
+		for {
+			env, err := msg.Receive()
+			if err != nil {
+				return
+			}
+			envs = append(envs, env)
+			if env.RequestID == 0 {
+				continue
+			}
+
+			var v int
+			if env.Kind != messenger.ModelRequest {
+				env.Decode(&v)
+			}
+			err = msg.Reply(env, v+offset)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return received
+}
+
+// record runs a replica's side of a session with a server at address, tracing it with payloads
+func record(t *testing.T, address string) []messenger.TraceEvent {
+	var trace bytes.Buffer
+	messenger.StartTracing(&trace, true)
+
+	msg, err := messenger.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = msg.Request(messenger.ModelRequest)
+	if err == nil {
+		err = msg.Send(messenger.ParameterUpdate, 3)
+	}
+	if err == nil {
+		_, err = msg.Request(messenger.ParameterRequest, 4)
+	}
+	msg.Close()
+	messenger.StopTracing()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := messenger.ReadTrace(bytes.NewReader(trace.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestRecordReplay(t *testing.T) {
+	recorded := serve(t, messenger.MemoryScheme+"recorded", 0)
+	events := record(t, messenger.MemoryScheme+"recorded")
+	original := <-recorded
+
+	// The trace holds both ends of the session, only the replica's is replayed
+	conns := ParameterConnections(events)
+	if len(conns) != 1 {
+		t.Fatalf("found %d connections to a parameter server, expected 1", len(conns))
+	}
+
+	for _, offset := range []int{0, 1} {
+		address := messenger.MemoryScheme + "replayed"
+		replayed := serve(t, address, offset)
+		report, err := Replay(events, conns, []string{address})
+		if err != nil {
+			t.Fatal(err)
+		}
+		envs := <-replayed
+
+		// The handshake counts as sent and received though Connect performs it, and replies only match the trace if the
+		// server behaves as the recorded one did
+		differing := 0
+		if offset != 0 {
+			differing = 2
+		}
+		expected := Report{Connections: 1, Sent: 4, Received: 3, Differing: differing}
+		if report != expected {
+			t.Errorf("offset %d: replay reported %+v, expected %+v", offset, report, expected)
+		}
+
+		if len(envs) != len(original) {
+			t.Fatalf("offset %d: server received %d envelopes in the replay, %d when recorded", offset, len(envs), len(original))
+		}
+		for i := range envs {
+			if envs[i].Kind != original[i].Kind || envs[i].RequestID != original[i].RequestID || !bytes.Equal(envs[i].Payload, original[i].Payload) {
+				t.Errorf("offset %d: envelope %d was replayed as %+v, recorded as %+v", offset, i, envs[i], original[i])
+			}
+		}
+	}
+}
+
+func TestReplayWithoutPayloads(t *testing.T) {
+	recorded := serve(t, messenger.MemoryScheme+"unrecorded", 0)
+	events := record(t, messenger.MemoryScheme+"unrecorded")
+	<-recorded
+
+	for i := range events {
+		events[i].Payload = nil
+	}
+	_, err := Replay(events, ParameterConnections(events), []string{messenger.MemoryScheme + "unreplayed"})
+	if err == nil {
+		t.Error("replayed a trace without payloads")
+	}
+}
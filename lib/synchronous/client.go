@@ -2,38 +2,67 @@ package synchronous
 
 import (
 	"comp3200/lib"
+	"comp3200/lib/compression"
+	"comp3200/lib/membership"
 	"comp3200/lib/messenger"
 	"comp3200/lib/network"
 	"log"
+	"time"
 
 	"gonum.org/v1/gonum/mat"
 )
 
 type client struct {
-	model *network.Network
-	data  network.Data
+	model      *network.Network
+	data       network.Data
+	compressor *compression.Compressor
 }
 
-// LaunchClient starts a synchronous model replica client and connects to a parameter ser ver
-func LaunchClient(paramAddress string) {
-	data := network.LoadData()
+// LaunchClient starts a synchronous model replica client training on data and connects to a parameter ser ver, compressing its deltas with scheme.
+// The client leaves once it has trained for trainFor, or trains for as long as it can if trainFor is zero
+func LaunchClient(paramAddress string, data *network.Data, scheme compression.Scheme, trainFor time.Duration) {
+	start := time.Now()
 
 	minibatches := data.GetMiniBatches(lib.MiniBatchSize)
 	idx := 0
 	batchesPerUpdate := 7
 	epochs := 0
 
-	param := messenger.Connect(paramAddress)
+	param, err := messenger.Connect(paramAddress)
+	if err != nil {
+		log.Println("ERR:", err)
+		return
+	}
+	defer param.Close()
+
+	// Heartbeats let the parameter server tell a slow client from a dead one
+	stopHeartbeat := param.StartHeartbeat()
+	defer stopHeartbeat()
 
 	client := client{}
 
-	param.SendMessage("MDL")
-	var networkConfig network.NetworkConfig
-	param.ReceiveInterface(&networkConfig)
+	networkConfig, agreed, err := compression.RequestModel(param, scheme)
+	if err != nil {
+		log.Println("ERR: could not retrieve model configuration", err)
+		return
+	}
 	client.model = network.NewNetworkFromConfig(networkConfig)
-	log.Println("Retrieved model configuration")
-	for {
-		client.receiveParameters(param)
+	client.compressor = compression.NewCompressor(agreed)
+	log.Println("Retrieved model configuration, compressing updates with", agreed)
+
+	member, err := membership.Join(param, membership.DefaultName())
+	if err != nil {
+		log.Println("ERR: could not join", err)
+		return
+	}
+	log.Println("Joined as member", member.ID)
+
+	for trainFor == 0 || time.Since(start) < trainFor {
+		err = client.receiveParameters(param)
+		if err != nil {
+			log.Println("ERR: could not receive parameters", err)
+			return
+		}
 
 		// Zero all parameters to get empty matrices to accumulate deltas in
 		weights, biases := client.model.ZeroedParameters()
@@ -58,35 +87,50 @@ func LaunchClient(paramAddress string) {
 		}
 
 		// Send update and wait for continue signal
-		client.sendDeltas(param, weights, biases)
-		client.waitForContinue(param)
+		err = client.sendDeltas(param, weights, biases)
+		if err == nil {
+			err = client.waitForContinue(param)
+		}
+		if err != nil {
+			log.Println("ERR: lost connection to parameter server", err)
+			return
+		}
+	}
+
+	err = membership.Leave(param)
+	if err != nil {
+		log.Println("ERR: could not leave", err)
+		return
 	}
+	log.Println("Left after training for", time.Since(start))
 }
 
-func (mr *client) receiveParameters(msg messenger.Messenger) {
+func (mr *client) receiveParameters(msg messenger.Messenger) error {
 	// Send request to parameter server
-	msg.SendMessage("REQ")
+	reply, err := msg.Request(messenger.ParameterRequest)
+	if err != nil {
+		return err
+	}
 
 	// Retrieve weights and biases for each layer from parameter server
 	var weights []mat.Dense
 	var biases []mat.VecDense
 
-	msg.ReceiveInterface(&weights)
-	msg.ReceiveInterface(&biases)
+	err = reply.Decode(&weights, &biases)
+	if err != nil {
+		return err
+	}
 
 	mr.model.SetParameters(weights, biases)
+	return nil
 }
 
-func (mr *client) sendDeltas(msg messenger.Messenger, weights []mat.Dense, biases []mat.VecDense) {
+func (mr *client) sendDeltas(msg messenger.Messenger, weights []mat.Dense, biases []mat.VecDense) error {
 	// send weight and bias deltas to parameter server
-	msg.SendMessage("UPD")
-	msg.SendInterface(weights)
-	msg.SendInterface(biases)
+	return compression.SendDeltas(msg, mr.compressor, 0, weights, biases)
 }
 
-func (mr *client) waitForContinue(msg messenger.Messenger) {
-	cmd := ""
-	for cmd != "CON" {
-		msg.ReceiveMessage(&cmd)
-	}
+// waitForContinue blocks until the continue signal arrives, the server sends heartbeats while we wait
+func (mr *client) waitForContinue(msg messenger.Messenger) error {
+	return msg.Expect(messenger.Continue)
 }
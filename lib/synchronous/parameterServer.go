@@ -1,136 +1,269 @@
 package synchronous
 
 import (
+	"comp3200/lib/compression"
+	"comp3200/lib/membership"
 	"comp3200/lib/messenger"
 	"comp3200/lib/network"
+	"errors"
+	"fmt"
 	"log"
-	"net"
 	"sync"
+	"time"
 
 	"gonum.org/v1/gonum/mat"
 )
 
 // SynchronousParameterServer is a struct that represents a parameter server using synchronous SGD
 type SynchronousParameterServer struct {
-	model            *network.Network
-	connectedClients []messenger.Messenger
-	clients          int
-	accumWeight      []mat.Dense
-	accumBias        []mat.VecDense
-	accumMutex       sync.Mutex
-}
+	model       *network.Network
+	accumWeight []mat.Dense
+	accumBias   []mat.VecDense
+
+	// registry holds the clients training, each round waits for a push from all but backups of them or for barrierTimeout after its first push.
+	// The first round also waits until clients have joined, and started is set once it has finished
+	registry       *membership.Registry
+	clients        int
+	backups        int
+	barrierTimeout time.Duration
+	started        bool
 
-var data *network.Data
+	// round counts the rounds finished, a push computed on the parameters of an earlier round comes from a straggler and is discarded.
+	// waiting holds each client that has pushed this round by member id, updateMutex guards both along with the accumulators
+	round       uint64
+	waiting     map[uint64]waiter
+	updateMutex sync.Mutex
+}
 
-// LaunchSynchronousParameterServer starts a sync parameter server with a specified number of expected clients
-func LaunchSynchronousParameterServer(address string, clients int, model *network.Network) {
-	data = network.LoadData()
+// waiter is a struct that represents a client waiting for the continue signal, with a function to stop the heartbeats sent to it meanwhile
+type waiter struct {
+	msg           messenger.Messenger
+	stopHeartbeat func()
+}
 
-	log.Println("Launching parameter server")
-	ps := SynchronousParameterServer{model: model, clients: clients}
+// LaunchSynchronousParameterServer starts a sync parameter server that waits for a specified number of clients to join before the first round.
+// Each round finishes once all but backups clients have pushed, or barrierTimeout after its first push unless barrierTimeout is zero
+func LaunchSynchronousParameterServer(address string, clients int, backups int, barrierTimeout time.Duration, model *network.Network) {
+	log.Println("Launching parameter server with", backups, "backup clients and barrier timeout", barrierTimeout)
+	ps := SynchronousParameterServer{model: model, clients: clients, backups: backups, barrierTimeout: barrierTimeout, registry: membership.NewRegistry(), waiting: make(map[uint64]waiter)}
 	ps.newAccumulators()
 
-	l, err := net.Listen("tcp4", address)
+	l, err := messenger.Listen(address)
 	if err != nil {
 		log.Println("ERR:", err)
 		return
 	}
 
-	connected := 0
+	err = messenger.Serve(l, ps.handleConnection)
+	log.Println("ERR:", err)
+}
 
-	// Only accept the number of clients specified
+func (ps *SynchronousParameterServer) newAccumulators() {
+	ps.accumWeight, ps.accumBias = ps.model.ZeroedParameters()
+}
+
+func (ps *SynchronousParameterServer) handleConnection(msg messenger.Messenger) {
+	log.Println("New model replica connected")
+	defer msg.Close()
+	// The compression scheme this client's updates use, agreed in its model request, and its membership once it has joined
+	scheme := compression.None
+	var member membership.Member
+	defer func() {
+		ps.leave(member.ID)
+	}()
+	// Receive skips heartbeats, so they are recorded here to keep an idle member's LastSeen current
+	msg.OnHeartbeat(func() {
+		ps.registry.Seen(member.ID)
+	})
+	// The round of the parameters this client last pulled
+	var pulled uint64
 	for {
-		conn, err := l.Accept()
-		if err != nil {
+		env, err := msg.Receive()
+
+		if err == nil {
+			ps.registry.Seen(member.ID)
+			switch env.Kind {
+			// Requesting parameters
+			case messenger.ParameterRequest:
+				pulled, err = ps.handleParameterRequest(msg, env)
+				break
+			case messenger.ParameterUpdate:
+				if member.ID == 0 {
+					err = fmt.Errorf("client has not joined: %w", messenger.Unexpected(env))
+				} else {
+					err = ps.handleParameterUpdate(member.ID, pulled, msg, env, scheme)
+				}
+				break
+			case messenger.ModelRequest:
+				scheme, err = ps.handleModelRequest(msg, env)
+				break
+			case messenger.Join:
+				member, err = ps.registry.HandleJoin(msg, env, member)
+				break
+			case messenger.Leave:
+				ps.leave(member.ID)
+				err = ps.registry.HandleLeave(msg, env, member.ID)
+				member = membership.Member{}
+				break
+			case messenger.MemberRequest:
+				err = ps.registry.HandleMemberRequest(msg, env)
+				break
+			default:
+				err = messenger.Unexpected(env)
+			}
+		}
+
+		if errors.Is(err, messenger.ErrPeerClosed) {
+			log.Println("Model replica disconnected")
+			return
+		} else if errors.Is(err, messenger.ErrTimeout) {
+			log.Println("Model replica timed out, assuming it is dead")
+			return
+		} else if err != nil {
 			log.Println("ERR:", err)
 			return
 		}
-		msg := messenger.NewMessenger(conn)
-		go ps.handleConnection(msg)
-		ps.connectedClients = append(ps.connectedClients, msg)
-		connected++
 	}
-
 }
 
-func (ps *SynchronousParameterServer) newAccumulators() {
-	weights, biases := ps.model.Parameters()
-	for i := 0; i < len(weights); i++ {
-		weights[i].Zero()
-		biases[i].Zero()
+// leave deregisters a client, so that the round no longer waits for it, and finishes the round if it was the last one waited for
+func (ps *SynchronousParameterServer) leave(id uint64) {
+	if id == 0 {
+		return
 	}
-	ps.accumWeight, ps.accumBias = weights, biases
-}
 
-func (ps *SynchronousParameterServer) handleConnection(msg messenger.Messenger) {
-	log.Println("New model replica connected")
-	for {
-		var cmd string
-		msg.ReceiveMessage(&cmd)
-
-		switch cmd {
-		// Requesting parameters
-		case "REQ":
-			ps.handleParameterRequest(msg)
-			break
-		case "UPD":
-			ps.handleParameterUpdate(msg)
-			break
-		case "MDL":
-			ps.handleModelRequest(msg)
-			break
+	var finished []waiter
+	ps.updateMutex.Lock()
+	if ps.registry.Deregister(id) {
+		if w, ok := ps.waiting[id]; ok {
+			w.stopHeartbeat()
+			delete(ps.waiting, id)
 		}
+		finished = ps.finishRound(false)
 	}
+	ps.updateMutex.Unlock()
+	continueWaiters(finished)
 }
 
-func (ps *SynchronousParameterServer) handleParameterRequest(msg messenger.Messenger) {
+// handleParameterRequest sends the current parameters and returns the round they are from
+func (ps *SynchronousParameterServer) handleParameterRequest(msg messenger.Messenger, request messenger.Envelope) (uint64, error) {
 	//fmt.Println("Received request for parameters")
+	ps.updateMutex.Lock()
+	round := ps.round
 	weights, biases := ps.model.Parameters()
+	ps.updateMutex.Unlock()
 
 	// send current state of weights and biases
-	msg.SendInterface(weights)
-	msg.SendInterface(biases)
+	return round, msg.Reply(request, weights, biases)
 }
 
-func (ps *SynchronousParameterServer) handleModelRequest(msg messenger.Messenger) {
-	msg.SendInterface(ps.model.Config)
+func (ps *SynchronousParameterServer) handleModelRequest(msg messenger.Messenger, request messenger.Envelope) (compression.Scheme, error) {
+	scheme := compression.Negotiate(request)
+	log.Println("Model replica compresses updates with", scheme)
+	return scheme, msg.Reply(request, ps.model.Config, scheme.String())
 }
 
-var updates int
-var updateMutex sync.Mutex
-
-func (ps *SynchronousParameterServer) handleParameterUpdate(msg messenger.Messenger) {
+// handleParameterUpdate adds a push computed on the parameters of round pulled to this round, or discards it if a later round has started
+func (ps *SynchronousParameterServer) handleParameterUpdate(id uint64, pulled uint64, msg messenger.Messenger, update messenger.Envelope, scheme compression.Scheme) error {
 
 	// receive deltas for weights and biases
-	var weightDeltas []mat.Dense
-	var biasDeltas []mat.VecDense
+	_, weightDeltas, biasDeltas, err := compression.ReceiveDeltas(update, scheme, ps.model)
+	if err != nil {
+		return err
+	}
 
-	msg.ReceiveInterface(&weightDeltas)
-	msg.ReceiveInterface(&biasDeltas)
+	ps.updateMutex.Lock()
+	if round := ps.round; pulled != round {
+		// The straggler carries on from the current parameters straight away
+		ps.updateMutex.Unlock()
+		log.Println("Discarded push from client", id, "computed in round", pulled, "during round", round)
+		return msg.Send(messenger.Continue)
+	}
 
-	updateMutex.Lock()
 	for i := 0; i < len(weightDeltas); i++ {
 		ps.accumWeight[i].Add(&ps.accumWeight[i], &weightDeltas[i])
 		ps.accumBias[i].AddVec(&ps.accumBias[i], &biasDeltas[i])
 	}
 
-	updates++
+	// Keep a waiting client from timing out while the barrier fills up
+	ps.waiting[id] = waiter{msg, msg.StartHeartbeat()}
 
-	// If we have received an update from every client
-	if updates >= ps.clients {
+	// The first push of a round starts its timeout
+	if len(ps.waiting) == 1 && ps.barrierTimeout > 0 {
+		ps.startTimeout(ps.round)
+	}
+	finished := ps.finishRound(false)
 
-		// Update the model, evaluate it and send the continue (CON) signal
-		ps.model.UpdateWithDeltas(ps.accumWeight, ps.accumBias)
+	ps.updateMutex.Unlock()
+	continueWaiters(finished)
+	return nil
+}
 
-		ps.newAccumulators()
+// startTimeout finishes a round with the pushes it has if it has not finished within the barrier timeout. The first round
+// still waits for the clients to join, so its timeout starts again until they have
+func (ps *SynchronousParameterServer) startTimeout(round uint64) {
+	time.AfterFunc(ps.barrierTimeout, func() {
+		var finished []waiter
+		ps.updateMutex.Lock()
+		if ps.round == round {
+			finished = ps.finishRound(true)
+			if finished != nil {
+				log.Println("Round", round, "timed out")
+			} else {
+				ps.startTimeout(round)
+			}
+		}
+		ps.updateMutex.Unlock()
+		continueWaiters(finished)
+	})
+}
 
-		updates = 0
+// finishRound applies the accumulated updates once all but the backups of the members have pushed, or as soon as any has
+// if the round has timed out, and returns the clients that waited for it. The first round also waits for the clients
+// the server was started with to join, even if it times out. updateMutex must be held
+func (ps *SynchronousParameterServer) finishRound(timedOut bool) []waiter {
+	members := ps.registry.Members()
+	needed := len(members) - ps.backups
+	if needed < 1 {
+		needed = 1
+	}
+	if len(ps.waiting) == 0 || (!ps.started && len(members) < ps.clients) || (!timedOut && len(ps.waiting) < needed) {
+		return nil
+	}
 
-		// Send CON signal to all clients
-		for _, m := range ps.connectedClients {
-			m.SendMessage("CON")
+	// Log every member whose push this round goes without, as "round,round,pushes,members" and a "dropped,round,member" line for each
+	log.Printf("round,%d,%d,%d\n", ps.round, len(ps.waiting), len(members))
+	for _, member := range members {
+		if _, ok := ps.waiting[member.ID]; !ok {
+			log.Printf("dropped,%d,%d\n", ps.round, member.ID)
 		}
 	}
 
-	updateMutex.Unlock()
+	// Update the model, evaluate it and send the continue (CON) signal
+	ps.model.UpdateWithDeltas(ps.accumWeight, ps.accumBias)
+
+	ps.newAccumulators()
+	ps.started = true
+	ps.round++
+
+	// Heartbeats must stop before CON is sent so that none arrive after it
+	finished := make([]waiter, 0, len(ps.waiting))
+	for _, w := range ps.waiting {
+		w.stopHeartbeat()
+		finished = append(finished, w)
+	}
+	ps.waiting = make(map[uint64]waiter)
+	return finished
+}
+
+// continueWaiters sends the continue (CON) signal to the clients that waited for a round. It is called without updateMutex,
+// so that a slow client does not hold up every other pull and push. A client that has gone away is removed when its
+// connection handler exits
+func continueWaiters(waiters []waiter) {
+	for _, w := range waiters {
+		err := w.msg.Send(messenger.Continue)
+		if err != nil {
+			log.Println("ERR: could not send continue signal", err)
+		}
+	}
 }
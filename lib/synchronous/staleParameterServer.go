@@ -0,0 +1,186 @@
+package synchronous
+
+import (
+	"comp3200/lib/compression"
+	"comp3200/lib/membership"
+	"comp3200/lib/messenger"
+	"comp3200/lib/network"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// StaleSynchronousParameterServer is a struct that represents a parameter server using stale synchronous parallel (SSP) SGD
+type StaleSynchronousParameterServer struct {
+	model     *network.Network
+	staleness int
+
+	// registry holds the clients training, clocks holds the clock of each by member id
+	registry   *membership.Registry
+	clocks     map[uint64]int
+	clockMutex sync.Mutex
+	clockCond  *sync.Cond
+}
+
+// LaunchStaleSynchronousParameterServer starts an SSP parameter server that only blocks clients more than staleness steps ahead of the slowest
+func LaunchStaleSynchronousParameterServer(address string, staleness int, model *network.Network) {
+	log.Println("Launching SSP parameter server with staleness", staleness)
+	ps := StaleSynchronousParameterServer{model: model, staleness: staleness, registry: membership.NewRegistry(), clocks: make(map[uint64]int)}
+	ps.clockCond = sync.NewCond(&ps.clockMutex)
+
+	l, err := messenger.Listen(address)
+	if err != nil {
+		log.Println("ERR:", err)
+		return
+	}
+
+	err = messenger.Serve(l, ps.handleConnection)
+	log.Println("ERR:", err)
+}
+
+// join registers a new client and starts its clock at that of the slowest client, joined is the membership the connection already has
+func (ps *StaleSynchronousParameterServer) join(msg messenger.Messenger, request messenger.Envelope, joined membership.Member) (membership.Member, error) {
+	member, err := ps.registry.HandleJoin(msg, request, joined)
+	if err != nil {
+		return member, err
+	}
+
+	ps.clockMutex.Lock()
+	ps.clocks[member.ID] = ps.minClock()
+	ps.clockMutex.Unlock()
+	return member, nil
+}
+
+// minClock returns the clock of the slowest client, clockMutex must be held
+func (ps *StaleSynchronousParameterServer) minClock() int {
+	min := -1
+	for _, clock := range ps.clocks {
+		if min == -1 || clock < min {
+			min = clock
+		}
+	}
+	if min == -1 {
+		return 0
+	}
+	return min
+}
+
+// leave deregisters a client and removes its clock so that it no longer holds back the other clients
+func (ps *StaleSynchronousParameterServer) leave(id uint64) {
+	if id == 0 {
+		return
+	}
+
+	ps.clockMutex.Lock()
+	ps.registry.Deregister(id)
+	delete(ps.clocks, id)
+	ps.clockCond.Broadcast()
+	ps.clockMutex.Unlock()
+}
+
+func (ps *StaleSynchronousParameterServer) handleConnection(msg messenger.Messenger) {
+	log.Println("New model replica connected")
+	defer msg.Close()
+	// The compression scheme this client's updates use, agreed in its model request, and its membership once it has joined
+	scheme := compression.None
+	var member membership.Member
+	defer func() {
+		ps.leave(member.ID)
+	}()
+	// Receive skips heartbeats, so they are recorded here to keep an idle member's LastSeen current
+	msg.OnHeartbeat(func() {
+		ps.registry.Seen(member.ID)
+	})
+	for {
+		env, err := msg.Receive()
+
+		if err == nil {
+			ps.registry.Seen(member.ID)
+			switch env.Kind {
+			// Requesting parameters
+			case messenger.ParameterRequest:
+				err = ps.handleParameterRequest(msg, env)
+				break
+			case messenger.ParameterUpdate:
+				if member.ID == 0 {
+					err = fmt.Errorf("client has not joined: %w", messenger.Unexpected(env))
+				} else {
+					err = ps.handleParameterUpdate(member.ID, msg, env, scheme)
+				}
+				break
+			case messenger.ModelRequest:
+				scheme, err = ps.handleModelRequest(msg, env)
+				break
+			case messenger.Join:
+				member, err = ps.join(msg, env, member)
+				break
+			case messenger.Leave:
+				ps.leave(member.ID)
+				err = ps.registry.HandleLeave(msg, env, member.ID)
+				member = membership.Member{}
+				break
+			case messenger.MemberRequest:
+				err = ps.registry.HandleMemberRequest(msg, env)
+				break
+			default:
+				err = messenger.Unexpected(env)
+			}
+		}
+
+		if errors.Is(err, messenger.ErrPeerClosed) {
+			log.Println("Client", member.ID, "disconnected")
+			return
+		} else if errors.Is(err, messenger.ErrTimeout) {
+			log.Println("Client", member.ID, "timed out, assuming it is dead")
+			return
+		} else if err != nil {
+			log.Println("ERR:", err)
+			return
+		}
+	}
+}
+
+func (ps *StaleSynchronousParameterServer) handleParameterRequest(msg messenger.Messenger, request messenger.Envelope) error {
+	weights, biases := ps.model.Parameters()
+
+	// send current state of weights and biases
+	return msg.Reply(request, weights, biases)
+}
+
+func (ps *StaleSynchronousParameterServer) handleModelRequest(msg messenger.Messenger, request messenger.Envelope) (compression.Scheme, error) {
+	scheme := compression.Negotiate(request)
+	log.Println("Model replica compresses updates with", scheme)
+	return scheme, msg.Reply(request, ps.model.Config, scheme.String())
+}
+
+func (ps *StaleSynchronousParameterServer) handleParameterUpdate(id uint64, msg messenger.Messenger, update messenger.Envelope, scheme compression.Scheme) error {
+
+	// receive deltas for weights and biases
+	_, weightDeltas, biasDeltas, err := compression.ReceiveDeltas(update, scheme, ps.model)
+	if err != nil {
+		return err
+	}
+
+	// Updates are applied immediately, only the continue signal is held back
+	ps.model.UpdateWithDeltas(weightDeltas, biasDeltas)
+
+	ps.clockMutex.Lock()
+	ps.clocks[id]++
+	ps.clockCond.Broadcast()
+
+	// Block this client while it is too far ahead of the slowest client
+	if ps.clocks[id]-ps.minClock() > ps.staleness {
+		log.Println("Client", id, "blocked at clock", ps.clocks[id], "slowest client at", ps.minClock())
+
+		// Keep the blocked client from timing out, heartbeats stop before CON is sent
+		stopHeartbeat := msg.StartHeartbeat()
+		for ps.clocks[id]-ps.minClock() > ps.staleness {
+			ps.clockCond.Wait()
+		}
+		stopHeartbeat()
+	}
+	ps.clockMutex.Unlock()
+
+	return msg.Send(messenger.Continue)
+}
@@ -0,0 +1,106 @@
+package synchronous
+
+import (
+	"comp3200/lib/compression"
+	"comp3200/lib/membership"
+	"comp3200/lib/messenger"
+	"comp3200/lib/network"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// servers counts the parameter servers started, as a server keeps its address until the process exits
+var servers int
+
+// joined connects a client to the server at address and joins as name
+func joined(t *testing.T, address string, name string) messenger.Messenger {
+	msg, err := messenger.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = compression.RequestModel(msg, compression.None)
+	if err == nil {
+		_, err = membership.Join(msg, name)
+	}
+	if err != nil {
+		msg.Close()
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// push sends an update of zeroes from a client and returns a channel that is closed once the server lets it continue
+func push(t *testing.T, msg messenger.Messenger, model *network.Network) <-chan bool {
+	weights, biases := model.ZeroedParameters()
+	err := compression.SendDeltas(msg, nil, 0, weights, biases)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	continued := make(chan bool)
+	go func() {
+		if msg.Expect(messenger.Continue) == nil {
+			close(continued)
+		}
+	}()
+	return continued
+}
+
+// continues checks whether a client is let continue within a second of pushing
+func continues(continued <-chan bool) bool {
+	select {
+	case <-continued:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestStalenessBound(t *testing.T) {
+	model := network.NewNetwork().WithLayer(4, 3, "sigmoid").WithLayer(3, 2, "softmax")
+	servers++
+	address := fmt.Sprintf("%sssp%d", messenger.MemoryScheme, servers)
+	go LaunchStaleSynchronousParameterServer(address, 2, model)
+
+	fast := joined(t, address, "fast")
+	defer fast.Close()
+	slow := joined(t, address, "slow")
+	defer slow.Close()
+
+	// The fast client may run up to the staleness bound ahead of the slow one, which has not pushed at all
+	for clock := 1; clock <= 2; clock++ {
+		if !continues(push(t, fast, model)) {
+			t.Fatalf("fast client was blocked at clock %d with the slow client at 0", clock)
+		}
+	}
+	blocked := push(t, fast, model)
+	select {
+	case <-blocked:
+		t.Fatal("fast client continued at clock 3 with the slow client at 0")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Once the slow client catches up to within the bound the fast client continues, and so does the slow client
+	if !continues(push(t, slow, model)) {
+		t.Fatal("slow client was blocked")
+	}
+	if !continues(blocked) {
+		t.Fatal("fast client stayed blocked at clock 3 with the slow client at 1")
+	}
+
+	// A client that leaves no longer holds back the others
+	blocked = push(t, fast, model)
+	select {
+	case <-blocked:
+		t.Fatal("fast client continued at clock 4 with the slow client at 1")
+	case <-time.After(100 * time.Millisecond):
+	}
+	err := membership.Leave(slow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !continues(blocked) {
+		t.Fatal("fast client stayed blocked after the slow client left")
+	}
+}
@@ -1,15 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"comp3200/lib"
+	"comp3200/lib/allreduce"
+	"comp3200/lib/async"
+	"comp3200/lib/compression"
 	"comp3200/lib/downpour"
+	"comp3200/lib/gossip"
+	"comp3200/lib/membership"
 	"comp3200/lib/messenger"
 	"comp3200/lib/network"
+	"comp3200/lib/replay"
 	"comp3200/lib/synchronous"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/rand"
+	"os"
 	"strings"
 	"time"
 )
@@ -21,33 +30,139 @@ func main() {
 	var address string
 	var nodeType string
 	var parameterAddress string
+	var timeout time.Duration
+	var heartbeat time.Duration
+	var codec string
+	var compressionScheme string
+	var link string
+	var peerLinks linkFlags
+	var tlsDir string
+	var secretFile string
+	var replayTrace string
+	var trainFor time.Duration
 
 	// Downpour parameters
 	var dataAddress string
 	var fetch int
 	var push int
 	var dataServers string
+	var shard int
+	var shards int
+	var backup string
+	var stalenessPolicy string
+	var optimiser string
+	var checkpoint string
 
 	// Synchronous parameters
 	var clients int
+	var backupClients int
+	var barrierTimeout time.Duration
+
+	// SSP parameters
+	var staleness int
+
+	// All-reduce and gossip parameters
+	var peers string
+	var topology string
+	var period int
 
 	// General
 	flag.StringVar(&algorithm, "algorithm", "downpour", "Algorithm to use for training")
 	flag.StringVar(&address, "host", "localhost:8888", "Host address")
 	flag.StringVar(&nodeType, "type", "none", "Type of entity this is: parameter, model, data")
-	flag.StringVar(&parameterAddress, "parameter", "localhost:8888", "Address of the parameter server")
+	flag.StringVar(&parameterAddress, "parameter", "localhost:8888", "Address of the parameter server, or comma-separated addresses of each shard")
+	flag.DurationVar(&timeout, "timeout", 30*time.Second, "Deadline for each send or receive, after which a peer is assumed dead (0 for none)")
+	flag.DurationVar(&heartbeat, "heartbeat", 5*time.Second, "Interval between heartbeats sent to keep idle connections alive (0 for none)")
+	flag.StringVar(&codec, "codec", "gob", "Encoding of the messages this node sends: gob, float64, float32")
+	flag.StringVar(&link, "link", "", "Emulated conditions of every link: a preset (datacentre, wan, flaky) or settings such as latency=40ms,jitter=10ms,dist=normal,bandwidth=12.5M,drop=0.001")
+	flag.Var(&peerLinks, "peerLink", "Emulated conditions of the link to one peer as <address>@<link>, may be repeated")
+	flag.StringVar(&tlsDir, "tls", "", "Directory holding ca.pem, node.pem and node-key.pem to secure every connection with mutual TLS, or to generate them in with -algorithm=certs")
+	flag.StringVar(&secretFile, "secretFile", "", "File holding a secret that every peer must prove it knows before its messages are processed")
+	flag.BoolVar(&lib.Tracing, "trace", false, "Record every message this node sends and receives to a JSONL trace next to its log")
+	flag.BoolVar(&lib.TracingPayloads, "tracePayloads", false, "Include the payload of each message in the trace, as needed to replay it")
+	flag.StringVar(&replayTrace, "replay", "", "Trace of a model replica recorded with -tracePayloads to replay against -parameter with -algorithm=replay")
+	flag.DurationVar(&trainFor, "trainFor", 0, "How long a model replica or client trains before leaving the cluster (0 for as long as it can)")
+	flag.StringVar(&compressionScheme, "compression", "none", "Compression of the deltas a model pushes: none, topk:<ratio>, random:<ratio>, 8bit, 1bit")
 
 	// Downpour specific
 	flag.StringVar(&dataAddress, "data", "", "Address of the data server for this model")
 	flag.IntVar(&fetch, "fetch", 10, "Number of mini-batches to fetch at a time")
 	flag.IntVar(&push, "push", 10, "Number of mini-batches to process before sending updates")
 	flag.StringVar(&dataServers, "dataServers", "", "Comma-separated addresses of data servers to provision")
+	flag.IntVar(&shard, "shard", 0, "Index of the parameter shard this server owns")
+	flag.IntVar(&shards, "shards", 1, "Number of shards the parameters are split across")
+	flag.StringVar(&stalenessPolicy, "stalenessPolicy", "none", "How a parameter server treats updates computed on stale parameters: none, drop:<max staleness>, scale, momentum:<momentum>")
+	flag.StringVar(&optimiser, "optimiser", "sgd", "How a parameter server applies updates: sgd, or adagrad:<learning rate> to scale each parameter's step by its accumulated squared gradients")
+	flag.StringVar(&checkpoint, "checkpoint", "", "File a parameter server restarts from if it exists and saves its parameters and Adagrad state to every minute")
+	flag.StringVar(&backup, "backup", "", "Address of the backup to stream updates to, or comma-separated backups of each shard for a model")
 
 	// Synchronous specific
 	flag.IntVar(&clients, "clients", 2, "Number of clients expected to connect")
+	flag.IntVar(&backupClients, "backupClients", 0, "Number of clients whose pushes each synchronous round may go without, stragglers' pushes being discarded")
+	flag.DurationVar(&barrierTimeout, "barrierTimeout", 0, "How long a synchronous round waits after its first push before going without the pushes still missing (0 for as long as it takes)")
+
+	// SSP specific
+	flag.IntVar(&staleness, "staleness", 3, "Number of steps a client may run ahead of the slowest client")
+
+	// All-reduce and gossip specific
+	flag.StringVar(&peers, "peers", "", "Comma-separated addresses of every peer, in order")
+	flag.StringVar(&topology, "topology", "ring", "Gossip topology: ring, random, full")
+	flag.IntVar(&period, "period", 10, "Number of mini-batches to train between gossip exchanges")
 
 	flag.Parse()
 
+	messenger.Timeout = timeout
+	messenger.HeartbeatInterval = heartbeat
+
+	var err error
+	messenger.DefaultCodec, err = messenger.ParseCodec(codec)
+	if err != nil {
+		log.Fatalln("ERR:", err)
+	}
+	scheme, err := compression.ParseScheme(compressionScheme)
+	if err != nil {
+		log.Fatalln("ERR:", err)
+	}
+	policy, err := downpour.ParseStalenessPolicy(stalenessPolicy)
+	if err != nil {
+		log.Fatalln("ERR:", err)
+	}
+	optimiserConfig, err := downpour.ParseOptimiser(optimiser)
+	if err != nil {
+		log.Fatalln("ERR:", err)
+	}
+	err = setupLinks(link, peerLinks)
+	if err != nil {
+		log.Fatalln("ERR:", err)
+	}
+
+	if algorithm == "certs" {
+		err = messenger.GenerateCertificates(tlsDir)
+		if err != nil {
+			log.Fatalln("ERR:", err)
+		}
+		return
+	}
+	err = setupSecurity(tlsDir, secretFile)
+	if err != nil {
+		log.Fatalln("ERR:", err)
+	}
+
+	if algorithm == "replay" {
+		err = replayParameterServer(replayTrace, strings.Split(parameterAddress, ","))
+		if err != nil {
+			log.Fatalln("ERR:", err)
+		}
+		return
+	}
+	if algorithm == "members" {
+		err = listMembers(strings.Split(parameterAddress, ","))
+		if err != nil {
+			log.Fatalln("ERR:", err)
+		}
+		return
+	}
+
 	if lib.LogMessages {
 		messenger.StartLoggingMessages()
 	}
@@ -66,13 +181,19 @@ func main() {
 		switch nodeType {
 		case "parameter":
 			lib.SetupLog("downpour/parameter")
-			go ContinuousParameterEvaluation(model, data.Test)
-			downpour.LaunchParameterServer(address, model, false)
+			if shards == 1 {
+				go ContinuousParameterEvaluation(model, data.Test)
+			} else if shard == 0 {
+				go ContinuousShardEvaluation(model, strings.Split(parameterAddress, ","), data.Test)
+			} else {
+				go ContinuousModelEvaluation()
+			}
+			downpour.LaunchParameterShard(address, model, shard, shards, backup, policy, optimiserConfig, checkpoint)
 			break
 		case "model":
 			lib.SetupLog("downpour/model")
 			go ContinuousModelEvaluation()
-			downpour.LaunchModelReplica(dataAddress, parameterAddress, 200, fetch, push)
+			downpour.LaunchModelReplica(dataAddress, data, strings.Split(parameterAddress, ","), strings.Split(backup, ","), 200, fetch, push, scheme, trainFor)
 			break
 		case "data":
 			lib.SetupLog("downpour/data")
@@ -81,7 +202,7 @@ func main() {
 		case "provision":
 			lib.SetupLog("downpour/provisioner")
 			addresses := strings.Split(dataServers, ",")
-			downpour.ProvisionData(addresses)
+			downpour.ProvisionData(addresses, data)
 			break
 		case "none":
 			break
@@ -91,11 +212,49 @@ func main() {
 		case "parameter":
 			lib.SetupLog("sync/parameter")
 			go ContinuousParameterEvaluation(model, data.Test)
-			synchronous.LaunchSynchronousParameterServer(address, clients, model)
+			synchronous.LaunchSynchronousParameterServer(address, clients, backupClients, barrierTimeout, model)
 			break
 		case "client":
 			lib.SetupLog("sync/model")
-			synchronous.LaunchClient(parameterAddress)
+			synchronous.LaunchClient(parameterAddress, data, scheme, trainFor)
+			break
+		}
+	} else if algorithm == "ssp" {
+		switch nodeType {
+		case "parameter":
+			lib.SetupLog("ssp/parameter")
+			go ContinuousParameterEvaluation(model, data.Test)
+			synchronous.LaunchStaleSynchronousParameterServer(address, staleness, model)
+			break
+		case "client":
+			lib.SetupLog("ssp/model")
+			synchronous.LaunchClient(parameterAddress, data, scheme, trainFor)
+			break
+		}
+	} else if algorithm == "allreduce" {
+		switch nodeType {
+		case "peer":
+			lib.SetupLog("allreduce/peer")
+			addresses := strings.Split(peers, ",")
+			if address == addresses[0] {
+				go ContinuousReplicaEvaluation(model, data.Test)
+			} else {
+				go ContinuousModelEvaluation()
+			}
+			allreduce.LaunchPeer(address, addresses, model, data)
+			break
+		}
+	} else if algorithm == "gossip" {
+		switch nodeType {
+		case "peer":
+			lib.SetupLog("gossip/peer")
+			addresses := strings.Split(peers, ",")
+			if address == addresses[0] {
+				go ContinuousReplicaEvaluation(model, data.Test)
+			} else {
+				go ContinuousModelEvaluation()
+			}
+			gossip.LaunchWorker(address, addresses, topology, period, model, data)
 			break
 		}
 	} else if algorithm == "async" {
@@ -103,16 +262,115 @@ func main() {
 		case "parameter":
 			lib.SetupLog("async/parameter")
 			go ContinuousParameterEvaluation(model, data.Test)
-			downpour.LaunchParameterServer(address, model, true)
+			async.LaunchParameterServer(address, model)
 			break
 		case "model":
 			lib.SetupLog("async/model")
 			go ContinuousModelEvaluation()
-			downpour.LaunchModelReplica("", parameterAddress, 20, 1, 1)
+			async.LaunchWorker(parameterAddress, data, scheme)
 		}
 	}
 }
 
+// linkFlags is a flag that collects every -peerLink given
+type linkFlags []string
+
+func (l *linkFlags) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *linkFlags) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// setupLinks configures the link emulator from the -link and -peerLink flags
+func setupLinks(link string, peerLinks []string) error {
+	if link != "" {
+		l, err := messenger.ParseLink(link)
+		if err != nil {
+			return err
+		}
+		messenger.SetDefaultLink(l)
+	}
+	for _, peerLink := range peerLinks {
+		parts := strings.SplitN(peerLink, "@", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("peer link %q is not of the form <address>@<link>", peerLink)
+		}
+		l, err := messenger.ParseLink(parts[1])
+		if err != nil {
+			return err
+		}
+		messenger.SetLink(parts[0], l)
+	}
+	return nil
+}
+
+// setupSecurity enables mutual TLS and the shared secret from the -tls and -secretFile flags
+func setupSecurity(tlsDir string, secretFile string) error {
+	if tlsDir != "" {
+		err := messenger.LoadTLS(tlsDir)
+		if err != nil {
+			return err
+		}
+	}
+	if secretFile != "" {
+		secret, err := ioutil.ReadFile(secretFile)
+		if err != nil {
+			return err
+		}
+		secret = bytes.TrimSpace(secret)
+		if len(secret) == 0 {
+			return fmt.Errorf("secret file %s is empty", secretFile)
+		}
+		messenger.SetSecret(secret)
+	}
+	return nil
+}
+
+// replayParameterServer re-drives the parameter servers at addresses with the messages a replica sent them in a trace
+func replayParameterServer(path string, addresses []string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	events, err := messenger.ReadTrace(file)
+	if err != nil {
+		return err
+	}
+
+	conns := replay.ParameterConnections(events)
+	if len(conns) == 0 {
+		return fmt.Errorf("%s has no connections to a parameter server", path)
+	}
+	report, err := replay.Replay(events, conns, addresses)
+	log.Printf("Replayed %d connections: sent %d messages, received %d of which %d differed from the trace\n", report.Connections, report.Sent, report.Received, report.Differing)
+	return err
+}
+
+// listMembers prints the members registered with each parameter server at addresses
+func listMembers(addresses []string) error {
+	for _, address := range addresses {
+		msg, err := messenger.Connect(address)
+		if err != nil {
+			return err
+		}
+		members, err := membership.Members(msg)
+		msg.Close()
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(len(members), "members of", address)
+		for _, member := range members {
+			fmt.Println(member, "joined", member.Joined.Format(time.RFC3339), "last seen", member.LastSeen.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
 // Wait for 1 minute
 var wait int = 1
 
@@ -121,21 +379,69 @@ func ContinuousParameterEvaluation(nn *network.Network, testData []network.Recor
 	for {
 		loss, accuracy := nn.Evaluate(testData)
 		curTime := count * wait
-		rx := messenger.Received()
-		tx := messenger.Sent()
-		log.Printf("%d,%f,%f,%d,%d\n", curTime, loss, accuracy, rx, tx)
+		traffic := messenger.TotalTraffic()
+		log.Printf("%d,%f,%f,%d,%d,%d,%d\n", curTime, loss, accuracy, traffic.Received.Messages, traffic.Sent.Messages, traffic.Received.Bytes, traffic.Sent.Bytes)
+		logTraffic(curTime, traffic)
+		count++
+		time.Sleep(time.Duration(wait) * time.Minute)
+	}
+}
+
+// ContinuousReplicaEvaluation evaluates a copy of a model that is being trained in this process
+func ContinuousReplicaEvaluation(nn *network.Network, testData []network.Record) {
+	count := 0
+	for {
+		loss, accuracy := nn.Clone().Evaluate(testData)
+		curTime := count * wait
+		traffic := messenger.TotalTraffic()
+		log.Printf("%d,%f,%f,%d,%d,%d,%d\n", curTime, loss, accuracy, traffic.Received.Messages, traffic.Sent.Messages, traffic.Received.Bytes, traffic.Sent.Bytes)
+		count++
+		time.Sleep(time.Duration(wait) * time.Minute)
+	}
+}
+
+// ContinuousShardEvaluation gathers the parameters of every shard and evaluates the complete model
+func ContinuousShardEvaluation(nn *network.Network, addresses []string, testData []network.Record) {
+	params, err := downpour.ConnectParameterShards(addresses, nil, compression.None)
+	if err != nil {
+		log.Println("ERR:", err)
+		return
+	}
+
+	// Evaluate a copy so that fetching other shards never overwrites this shard's model
+	eval := nn.Clone()
+
+	count := 0
+	for {
+		err = params.Fetch(eval)
+		if err != nil {
+			log.Println("ERR: could not fetch parameters from every shard", err)
+			return
+		}
+		loss, accuracy := eval.Evaluate(testData)
+		curTime := count * wait
+		traffic := messenger.TotalTraffic()
+		log.Printf("%d,%f,%f,%d,%d,%d,%d\n", curTime, loss, accuracy, traffic.Received.Messages, traffic.Sent.Messages, traffic.Received.Bytes, traffic.Sent.Bytes)
+		logTraffic(curTime, traffic)
 		count++
 		time.Sleep(time.Duration(wait) * time.Minute)
 	}
 }
 
+// logTraffic logs the messages and bytes of each kind this process has received and sent
+func logTraffic(curTime int, traffic messenger.Traffic) {
+	for _, kind := range traffic.Kinds() {
+		rx, tx := traffic.ReceivedByKind[kind], traffic.SentByKind[kind]
+		log.Printf("traffic,%d,%s,%d,%d,%d,%d\n", curTime, kind, rx.Messages, tx.Messages, rx.Bytes, tx.Bytes)
+	}
+}
+
 func ContinuousModelEvaluation() {
 	count := 0
 	for {
 		curTime := count * wait
-		rx := messenger.Received()
-		tx := messenger.Sent()
-		log.Printf("%d,%d,%d\n", curTime, rx, tx)
+		traffic := messenger.TotalTraffic()
+		log.Printf("%d,%d,%d,%d,%d\n", curTime, traffic.Received.Messages, traffic.Sent.Messages, traffic.Received.Bytes, traffic.Sent.Bytes)
 		count++
 		time.Sleep(time.Duration(wait) * time.Minute)
 	}
@@ -0,0 +1,15 @@
+#!/bin/bash
+
+source scripts/setup.sh
+
+rm -rf log/allreduce/*.log
+
+peers=(":8900" ":8901" ":8902" ":8903")
+joined_peers=":8900,:8901,:8902,:8903"
+
+echo "Creating peers"
+for p in ${peers[@]}; do
+    $exe -algorithm=allreduce -type=peer -host=$p -peers=$joined_peers &
+done
+
+wait
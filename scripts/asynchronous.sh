@@ -14,8 +14,6 @@ replicas=(":8900" ":8901" ":8902" ":8903" ":8904" ":8905" ":8906" ":8907")
 echo "Creating parameter server"
 $exe -algorithm=async -type=parameter -host=$parameter &
 
-sleep 2
-
 echo "Creating model replicas"
 for i in ${!replicas[@]}; do
     $exe -algorithm=async -type=model -parameter=$parameter &
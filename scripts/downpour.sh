@@ -4,7 +4,22 @@ source scripts/setup.sh
 
 rm -rf log/downpour/*.log
 
-parameter=":8889"
+parameters=(":8889")
+joined_parameters=":8889"
+
+# parameters=(":8887" ":8888" ":8889")
+# joined_parameters=":8887,:8888,:8889"
+
+# Unix domain sockets avoid TCP overhead and port clashes between experiments on one machine
+# parameters=("unix:///tmp/downpour-parameter.sock")
+# joined_parameters="unix:///tmp/downpour-parameter.sock"
+
+# Optional backup parameter servers, one per shard
+backups=()
+joined_backups=""
+
+# backups=(":8879")
+# joined_backups=":8879"
 
 # replicas=(":8900" ":8901" ":8902" ":8903" ":8908" ":8909" ":8910" ":8911")
 # data=(":8890" ":8891" ":8892" ":8893"  ":8908" ":8909" ":8910" ":8911")
@@ -18,6 +33,12 @@ parameter=":8889"
 # data=(":8890" ":8891")
 # joined_data=":8890,:8891"
 
+# How parameter servers apply updates: sgd, adagrad:<learning rate>
+optimiser="sgd"
+
+# Compression of the deltas replicas push: none, topk:<ratio>, random:<ratio>, 8bit, 1bit
+compression="none"
+
 replicas=(":8900" ":8901" ":8902" ":8903")
 data=(":8890" ":8891" ":8892" ":8893")
 joined_data=":8890,:8891,:8892,:8893"
@@ -27,19 +48,24 @@ for a in ${data[@]}; do
     $exe -type=data -algorithm=downpour -host=$a &
 done
 
-sleep 1
-
 echo "Provisioning data servers"
 $exe -type=provision -dataServers=$joined_data
 
-echo "Creating parameter server"
-$exe -algorithm=downpour -type=parameter -host=$parameter &
+if [ ${#backups[@]} -gt 0 ]; then
+    echo "Creating backup parameter servers"
+    for i in ${!backups[@]}; do
+        $exe -algorithm=downpour -type=parameter -host=${backups[i]} -parameter=$joined_backups -shard=$i -shards=${#parameters[@]} &
+    done
+fi
 
-sleep 2
+echo "Creating parameter server shards"
+for i in ${!parameters[@]}; do
+    $exe -algorithm=downpour -type=parameter -host=${parameters[i]} -parameter=$joined_parameters -shard=$i -shards=${#parameters[@]} -backup=${backups[i]} -optimiser=$optimiser &
+done
 
 echo "Creating model replicas"
 for i in ${!replicas[@]}; do
-    $exe -algorithm=downpour -type=model -data=${data[i]} -parameter=$parameter -fetch=100 -push=20 &
+    $exe -algorithm=downpour -type=model -data=${data[i]} -parameter=$joined_parameters -backup=$joined_backups -fetch=100 -push=20 -compression=$compression &
 done
 
 wait
\ No newline at end of file
@@ -0,0 +1,17 @@
+#!/bin/bash
+
+source scripts/setup.sh
+
+rm -rf log/gossip/*.log
+
+peers=(":8900" ":8901" ":8902" ":8903")
+joined_peers=":8900,:8901,:8902,:8903"
+topology="ring"
+period=10
+
+echo "Creating peers"
+for p in ${peers[@]}; do
+    $exe -algorithm=gossip -type=peer -host=$p -peers=$joined_peers -topology=$topology -period=$period &
+done
+
+wait
@@ -0,0 +1,19 @@
+#!/bin/bash
+
+source scripts/setup.sh
+
+rm -rf log/ssp/*.log
+
+parameter=":8889"
+clients=8
+staleness=3
+
+echo "Creating parameter server"
+$exe -algorithm=ssp -type=parameter -host=$parameter -staleness=$staleness &
+
+echo "Creating clients"
+for i in $(seq 1 $clients); do
+    $exe -algorithm=ssp -type=client -parameter=$parameter &
+done
+
+wait
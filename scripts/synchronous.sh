@@ -7,14 +7,19 @@ rm -rf log/sync/*.log
 parameter=":8889"
 clients=8
 
-echo "Creating parameter server"
-$exe -algorithm=sync -type=parameter -host=$parameter -clients=$clients &
+# Rounds may go without the pushes of this many clients, and go without any still missing this long after their first push (0s for never)
+backup_clients=0
+barrier_timeout=0s
+
+# Compression of the deltas clients push: none, topk:<ratio>, random:<ratio>, 8bit, 1bit
+compression="none"
 
-sleep 1
+echo "Creating parameter server"
+$exe -algorithm=sync -type=parameter -host=$parameter -clients=$clients -backupClients=$backup_clients -barrierTimeout=$barrier_timeout &
 
 echo "Creating clients"
 for i in $(seq 1 $clients); do
-    $exe -algorithm=sync -type=client -parameter=$parameter &
+    $exe -algorithm=sync -type=client -parameter=$parameter -compression=$compression &
 done
 
 wait
\ No newline at end of file